@@ -0,0 +1,515 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
+)
+
+// A flash backup file starts with the magic bytes, followed by the
+// length of the JSON encoded header as a little-endian uint32, the
+// header, and the content of the regions in the order they are listed
+// in the header.
+const flashBackupMagic = "JAGFLASH"
+
+type flashBackupHeader struct {
+	Version   int                 `json:"version"`
+	Created   time.Time           `json:"created"`
+	Chip      string              `json:"chip"`
+	FlashSize int                 `json:"flashSize"`
+	Device    *flashBackupDevice  `json:"device,omitempty"`
+	Regions   []flashBackupRegion `json:"regions"`
+}
+
+// flashBackupDevice is the Jaguar identity found in the active firmware
+// when the backup was taken.
+type flashBackupDevice struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type flashBackupRegion struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type flashBackup struct {
+	Header flashBackupHeader
+	Data   [][]byte
+}
+
+// find returns the data of the backup between offset and offset+size, if
+// a single region covers all of it.
+func (b *flashBackup) find(offset int, size int) ([]byte, bool) {
+	for i, r := range b.Header.Regions {
+		if r.Offset <= offset && offset+size <= r.Offset+r.Size {
+			return b.Data[i][offset-r.Offset : offset-r.Offset+size], true
+		}
+	}
+	return nil, false
+}
+
+func (b *flashBackup) write(w io.Writer) error {
+	header, err := json.Marshal(b.Header)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(header)))
+	for _, chunk := range append([][]byte{[]byte(flashBackupMagic), length, header}, b.Data...) {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFlashBackup reads a backup file written by 'jag flash backup' and
+// verifies the checksums of all regions.
+func readFlashBackup(path string) (*flashBackup, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isFlashBackup(content) {
+		return nil, fmt.Errorf("'%s' is not a flash backup", path)
+	}
+	content = content[len(flashBackupMagic):]
+	if len(content) < 4 {
+		return nil, fmt.Errorf("'%s' is truncated", path)
+	}
+	length := int(binary.LittleEndian.Uint32(content))
+	content = content[4:]
+	if len(content) < length {
+		return nil, fmt.Errorf("'%s' is truncated", path)
+	}
+
+	res := &flashBackup{}
+	if err := json.Unmarshal(content[:length], &res.Header); err != nil {
+		return nil, fmt.Errorf("failed to parse header of '%s': %w", path, err)
+	}
+	if res.Header.Version != 1 {
+		return nil, fmt.Errorf("unsupported flash backup version %d in '%s'", res.Header.Version, path)
+	}
+	content = content[length:]
+
+	for _, r := range res.Header.Regions {
+		if len(content) < r.Size {
+			return nil, fmt.Errorf("'%s' is truncated", path)
+		}
+		data := content[:r.Size]
+		content = content[r.Size:]
+		digest := sha256.Sum256(data)
+		if hex.EncodeToString(digest[:]) != r.SHA256 {
+			return nil, fmt.Errorf("checksum of region '%s' in '%s' does not match", r.Name, path)
+		}
+		res.Data = append(res.Data, data)
+	}
+	return res, nil
+}
+
+func isFlashBackup(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(flashBackupMagic))
+}
+
+// identity looks for the Jaguar config in the app partition the device
+// boots from. That is only possible if the backup has the partition
+// table, the OTA data and the app partition.
+func (b *flashBackup) identity(chip *esploader.Chip) *flashBackupDevice {
+	tableData, ok := b.find(partitionTableOffset, partitionTableSize)
+	if !ok {
+		return nil
+	}
+	table, err := ParsePartitionsBinary(tableData, "backup", chip)
+	if err != nil {
+		return nil
+	}
+	var otadata []byte
+	if p, ok := table.Find("ota"); ok {
+		otadata, _ = b.find(p.Offset, p.Size)
+	}
+	app, ok := activeAppPartition(table, otadata)
+	if !ok {
+		return nil
+	}
+	appData, ok := b.find(app.Offset, app.Size)
+	if !ok {
+		return nil
+	}
+	config, ok := findImageConfig(appData)
+	if !ok {
+		return nil
+	}
+	if _, ok := config["id"]; !ok {
+		// The device was flashed with an image built for many devices,
+		// so it keeps the id it created for itself elsewhere.
+		return nil
+	}
+	res := &flashBackupDevice{}
+	res.ID, _ = config["id"].(string)
+	res.Name, _ = config["name"].(string)
+	return res
+}
+
+// images returns the images to write when restoring the partitions with
+// the given names, or all of the backup if there are none. A partition
+// is either a region of its own in the backup or it is found through the
+// partition table in a backup of the entire flash.
+func (b *flashBackup) images(partitionNames []string, path string) ([]esploader.Image, error) {
+	var res []esploader.Image
+	if len(partitionNames) == 0 {
+		for i, r := range b.Header.Regions {
+			res = append(res, esploader.Image{Name: r.Name, Offset: uint32(r.Offset), Data: b.Data[i]})
+		}
+		return res, nil
+	}
+
+	var table *PartitionTable
+	for _, name := range partitionNames {
+		image, found := esploader.Image{}, false
+		for i, r := range b.Header.Regions {
+			if r.Name == name {
+				image, found = esploader.Image{Name: r.Name, Offset: uint32(r.Offset), Data: b.Data[i]}, true
+				break
+			}
+		}
+		if !found {
+			if table == nil {
+				var err error
+				if table, err = b.partitionTable(); err != nil {
+					return nil, fmt.Errorf("there is no partition named '%s' in '%s': %w", name, path, err)
+				}
+			}
+			for _, p := range table.Partitions {
+				if p.Name != name {
+					continue
+				}
+				if data, ok := b.find(p.Offset, p.Size); ok {
+					image, found = esploader.Image{Name: p.Name, Offset: uint32(p.Offset), Data: data}, true
+				}
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("there is no partition named '%s' in '%s'", name, path)
+		}
+		res = append(res, image)
+	}
+	return res, nil
+}
+
+// partitionTable returns the partition table stored in the backup.
+func (b *flashBackup) partitionTable() (*PartitionTable, error) {
+	chip, err := esploader.ChipByName(b.Header.Chip)
+	if err != nil {
+		return nil, err
+	}
+	tableData, ok := b.find(partitionTableOffset, partitionTableSize)
+	if !ok {
+		return nil, fmt.Errorf("the backup has no partition table")
+	}
+	return ParsePartitionsBinary(tableData, "backup", chip)
+}
+
+// connectForFlashAccess connects to the device and prepares it for
+// reading and writing the flash at the given baud rate.
+func connectForFlashAccess(cmd *cobra.Command) (*esploader.Loader, int, error) {
+	chipName, err := cmd.Flags().GetString("chip")
+	if err != nil {
+		return nil, 0, err
+	}
+	if chipName != "auto" {
+		chip, err := esploader.ChipByName(chipName)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := checkFlashAccessChip(chip); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	port, err := cmd.Flags().GetString("port")
+	if err != nil {
+		return nil, 0, err
+	}
+	if port, err = CheckPort(port); err != nil {
+		return nil, 0, err
+	}
+
+	baud, err := cmd.Flags().GetUint("baud")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	loader, err := connectLoader(port, chipName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkFlashAccessChip(loader.Chip()); err != nil {
+		loader.Close()
+		return nil, 0, fmt.Errorf("the device on port '%s': %w", port, err)
+	}
+
+	if err := loader.ChangeBaudRate(int(baud)); err != nil {
+		loader.Close()
+		return nil, 0, fmt.Errorf("failed to change baud rate: %w", err)
+	}
+
+	flashSize, err := loader.DetectFlashSize()
+	if err != nil {
+		loader.Close()
+		return nil, 0, err
+	}
+	if err := loader.SetFlashSize(flashSize); err != nil {
+		loader.Close()
+		return nil, 0, err
+	}
+	return loader, int(flashSize), nil
+}
+
+func FlashBackupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup <file>",
+		Short: "Back up the flash of a device over serial",
+		Long: "Read the flash of a device over serial and write it to a file. Without\n" +
+			"'--partition' the entire flash is read. The file records the chip, the\n" +
+			"flash size and, if it can be found, the Jaguar identity of the device.\n" +
+			"The ROM bootloader reads 64 bytes at a time, so reading the entire flash\n" +
+			"takes several minutes. Only the ESP32 can be backed up.\n" +
+			"Use 'jag flash restore' to write the backup back to a device.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			partitionNames, err := cmd.Flags().GetStringArray("partition")
+			if err != nil {
+				return err
+			}
+
+			loader, flashSize, err := connectForFlashAccess(cmd)
+			if err != nil {
+				return err
+			}
+			defer loader.Close()
+			chip := loader.Chip()
+
+			backup := &flashBackup{
+				Header: flashBackupHeader{
+					Version:   1,
+					Created:   time.Now(),
+					Chip:      chip.Name,
+					FlashSize: flashSize,
+				},
+			}
+
+			var regions []flashBackupRegion
+			if len(partitionNames) == 0 {
+				regions = append(regions, flashBackupRegion{Name: "flash", Offset: 0, Size: flashSize})
+			} else {
+				tableData, err := loader.ReadFlash(partitionTableOffset, partitionTableSize, nil)
+				if err != nil {
+					return err
+				}
+				table, err := ParsePartitionsBinary(tableData, "the device flash", chip)
+				if err != nil {
+					return err
+				}
+				for _, name := range partitionNames {
+					found := false
+					for _, p := range table.Partitions {
+						if p.Name == name {
+							regions = append(regions, flashBackupRegion{Name: p.Name, Offset: p.Offset, Size: p.Size})
+							found = true
+							break
+						}
+					}
+					if !found {
+						return fmt.Errorf("the device has no partition named '%s'", name)
+					}
+				}
+			}
+
+			total := 0
+			for _, r := range regions {
+				total += r.Size
+			}
+			fmt.Printf("Reading %d bytes of flash from %s device ...\n", total, chip.Name)
+			bar := pb.New(total).Start()
+			done := 0
+			for _, r := range regions {
+				data, err := loader.ReadFlash(uint32(r.Offset), r.Size, func(read int) {
+					bar.SetCurrent(int64(done + read))
+				})
+				if err != nil {
+					bar.Finish()
+					return fmt.Errorf("failed to read %s: %w", r.Name, err)
+				}
+				done += r.Size
+				digest := sha256.Sum256(data)
+				r.SHA256 = hex.EncodeToString(digest[:])
+				backup.Header.Regions = append(backup.Header.Regions, r)
+				backup.Data = append(backup.Data, data)
+			}
+			bar.Finish()
+			loader.HardReset()
+
+			backup.Header.Device = backup.identity(chip)
+
+			file, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			if err := backup.write(file); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+
+			if device := backup.Header.Device; device != nil {
+				fmt.Printf("Backed up device '%s' (%s) to '%s'\n", device.Name, device.ID, args[0])
+			} else {
+				fmt.Printf("Backed up the device to '%s'\n", args[0])
+			}
+			return nil
+		},
+	}
+
+	addFlashAccessFlags(cmd)
+	cmd.Flags().StringArray("partition", nil, "back up the partition with the given name instead of the entire flash (can be repeated)")
+	return cmd
+}
+
+func FlashRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Restore a flash backup to a device over serial",
+		Long: "Write a backup made with 'jag flash backup' to the flash of a device over\n" +
+			"serial. The checksums in the backup are verified before anything is written\n" +
+			"and the device must have the same chip and at least as much flash as the\n" +
+			"device the backup was taken from. With '--partition' only the given\n" +
+			"partitions are written, also when the backup has the entire flash.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			partitionNames, err := cmd.Flags().GetStringArray("partition")
+			if err != nil {
+				return err
+			}
+
+			backup, err := readFlashBackup(args[0])
+			if err != nil {
+				return err
+			}
+			header := backup.Header
+
+			images, err := backup.images(partitionNames, args[0])
+			if err != nil {
+				return err
+			}
+
+			chipName, err := cmd.Flags().GetString("chip")
+			if err != nil {
+				return err
+			}
+			if chip, err := esploader.ChipByName(chipName); err == nil && chip.Name != header.Chip {
+				return fmt.Errorf("the backup was taken from an %s, not an %s", header.Chip, chip.Name)
+			}
+
+			loader, flashSize, err := connectForFlashAccess(cmd)
+			if err != nil {
+				return err
+			}
+			defer loader.Close()
+			chip := loader.Chip()
+
+			if chip.Name != header.Chip {
+				return fmt.Errorf("the backup was taken from an %s, but the device is an %s", header.Chip, chip.Name)
+			}
+			for _, image := range images {
+				if end := int(image.Offset) + len(image.Data); end > flashSize {
+					return fmt.Errorf("the device only has %d bytes of flash, but '%s' ends at 0x%x", flashSize, image.Name, end)
+				}
+			}
+
+			if device := header.Device; device != nil {
+				fmt.Printf("Restoring backup of device '%s' (%s) taken %s ...\n", device.Name, device.ID, header.Created.Format(time.RFC1123))
+			} else {
+				fmt.Printf("Restoring backup taken %s ...\n", header.Created.Format(time.RFC1123))
+			}
+
+			var bar *pb.ProgressBar
+			options := esploader.FlashOptions{
+				// Write the backup exactly as it was read.
+				FlashMode: "keep",
+				FlashFreq: "keep",
+				FlashSize: "keep",
+				Progress: func(written int, total int) {
+					if bar == nil {
+						bar = pb.New(total).Start()
+					}
+					bar.SetCurrent(int64(written))
+				},
+			}
+			err = loader.WriteFlash(images, options)
+			if bar != nil {
+				bar.Finish()
+			}
+			if err != nil {
+				return err
+			}
+
+			loader.HardReset()
+			fmt.Println("Successfully restored and rebooted the device")
+			return nil
+		},
+	}
+
+	addFlashAccessFlags(cmd)
+	cmd.Flags().StringArray("partition", nil, "only restore the partition with the given name (can be repeated)")
+	return cmd
+}
+
+// flashAccessChipNames returns the names of the chips that can be backed
+// up and restored.
+func flashAccessChipNames() []string {
+	var res []string
+	for _, c := range esploader.Chips {
+		if c.CanReadFlash() {
+			res = append(res, c.Name)
+		}
+	}
+	return res
+}
+
+// checkFlashAccessChip returns an error if the chip can't be backed up
+// and restored.
+func checkFlashAccessChip(chip *esploader.Chip) error {
+	if chip.CanReadFlash() {
+		return nil
+	}
+	return fmt.Errorf("the flash of the %s can't be read over serial, so it can't be backed up or restored; only %s devices are supported", chip, strings.Join(flashAccessChipNames(), ", "))
+}
+
+func addFlashAccessFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to use")
+	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial connection")
+	cmd.Flags().String("chip", "auto", "chip of the device ("+strings.Join(flashAccessChipNames(), ", ")+"), or auto to detect it")
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
+)
+
+func testFullBackup(t *testing.T) *flashBackup {
+	csv := "nvs, data, nvs, 0x9000, 0x4000\n" +
+		"otadata, data, ota, 0xd000, 0x2000\n" +
+		"ota_0, app, ota_0, 0x10000, 0x10000\n"
+	table, err := ParsePartitions(strings.NewReader(csv), "test", esploader.ESP32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := table.Binary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flash := make([]byte, 0x20000)
+	for i := range flash {
+		flash[i] = byte(i >> 12)
+	}
+	copy(flash[partitionTableOffset:], binary)
+	return &flashBackup{
+		Header: flashBackupHeader{
+			Chip:      "esp32",
+			FlashSize: len(flash),
+			Regions:   []flashBackupRegion{{Name: "flash", Offset: 0, Size: len(flash)}},
+		},
+		Data: [][]byte{flash},
+	}
+}
+
+func TestFlashBackupImages(t *testing.T) {
+	backup := testFullBackup(t)
+	flash := backup.Data[0]
+
+	images, err := backup.images(nil, "full.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "flash" || images[0].Offset != 0 || len(images[0].Data) != len(flash) {
+		t.Errorf("images(nil) = %v, want the entire flash", images)
+	}
+
+	images, err = backup.images([]string{"ota_0", "nvs"}, "full.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name   string
+		offset int
+		size   int
+	}{
+		{"ota_0", 0x10000, 0x10000},
+		{"nvs", 0x9000, 0x4000},
+	}
+	if len(images) != len(want) {
+		t.Fatalf("got %d images, want %d", len(images), len(want))
+	}
+	for i, w := range want {
+		image := images[i]
+		if image.Name != w.name || int(image.Offset) != w.offset || !bytes.Equal(image.Data, flash[w.offset:w.offset+w.size]) {
+			t.Errorf("image %d is %s at 0x%x with %d bytes, want %s at 0x%x with %d bytes", i, image.Name, image.Offset, len(image.Data), w.name, w.offset, w.size)
+		}
+	}
+
+	if _, err := backup.images([]string{"ota_1"}, "full.bin"); err == nil {
+		t.Errorf("images found a partition that isn't there")
+	}
+}
+
+func TestFlashBackupImagesByRegion(t *testing.T) {
+	backup := &flashBackup{
+		Header: flashBackupHeader{
+			Chip:    "esp32",
+			Regions: []flashBackupRegion{{Name: "nvs", Offset: 0x9000, Size: 4}},
+		},
+		Data: [][]byte{{1, 2, 3, 4}},
+	}
+	images, err := backup.images([]string{"nvs"}, "nvs.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Offset != 0x9000 || !bytes.Equal(images[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("images = %v, want the nvs region", images)
+	}
+	// There is no partition table to find other partitions in.
+	if _, err := backup.images([]string{"ota_0"}, "nvs.bin"); err == nil {
+		t.Errorf("images found a partition that isn't there")
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// batchEntry is a row of the manifest given to 'jag flash --batch'
+// together with the outcome of flashing the device.
+type batchEntry struct {
+	Port         string `json:"port"`
+	USBSerial    string `json:"usbSerial,omitempty"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Chip         string `json:"-"`
+	WifiSSID     string `json:"-"`
+	WifiPassword string `json:"-"`
+	WifiProfile  string `json:"-"`
+	Address      string `json:"address,omitempty"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+}
+
+const (
+	batchStatusOK            = "ok"
+	batchStatusFlashFailed   = "flash-failed"
+	batchStatusNotIdentified = "not-identified"
+)
+
+func readBatchManifest(path string) ([]*batchEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %w", path, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the manifest '%s' is empty", path)
+	}
+
+	columns := map[string]int{}
+	for i, column := range rows[0] {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "port", "name", "wifi-ssid", "wifi-password", "wifi-profile", "chip":
+			columns[column] = i
+		default:
+			return nil, fmt.Errorf("unknown column '%s' in '%s'", column, path)
+		}
+	}
+	if _, ok := columns["port"]; !ok {
+		return nil, fmt.Errorf("the manifest '%s' has no 'port' column", path)
+	}
+
+	var res []*batchEntry
+	ports := map[string]bool{}
+	for _, row := range rows[1:] {
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		entry := &batchEntry{
+			Port:         get("port"),
+			Name:         get("name"),
+			Chip:         get("chip"),
+			WifiSSID:     get("wifi-ssid"),
+			WifiPassword: get("wifi-password"),
+			WifiProfile:  get("wifi-profile"),
+		}
+		if entry.Port == "" {
+			return nil, fmt.Errorf("missing port in '%s'", path)
+		}
+		if ports[entry.Port] {
+			return nil, fmt.Errorf("port '%s' is listed more than once in '%s'", entry.Port, path)
+		}
+		ports[entry.Port] = true
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+// identifyListener keeps track of the devices that announce themselves
+// on the network while the batch is running. There can only be one
+// listener on the identify port, so all flashing jobs share it.
+type identifyListener struct {
+	sync.Mutex
+	devices map[string]Device
+}
+
+func listenForIdentify(ctx context.Context, port uint) (*identifyListener, error) {
+	pc, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &identifyListener{
+		devices: map[string]Device{},
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			dev, err := parseDevice(buf[:n])
+			if err != nil || dev == nil {
+				continue
+			}
+			res.Lock()
+			res.devices[dev.ID] = *dev
+			res.Unlock()
+		}
+	}()
+	return res, nil
+}
+
+func (l *identifyListener) waitFor(ctx context.Context, id string) (*Device, error) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		l.Lock()
+		dev, ok := l.devices[id]
+		l.Unlock()
+		if ok {
+			return &dev, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func flashBatch(cmd *cobra.Command, manifest string) error {
+	ctx := cmd.Context()
+	entries, err := readBatchManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	baud, err := cmd.Flags().GetUint("baud")
+	if err != nil {
+		return err
+	}
+
+	defaultChip, err := cmd.Flags().GetString("chip")
+	if err != nil {
+		return err
+	}
+
+	jobs, err := cmd.Flags().GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	if jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+
+	identifyTimeout, err := cmd.Flags().GetDuration("identify-timeout")
+	if err != nil {
+		return err
+	}
+
+	reportPath, err := cmd.Flags().GetString("report")
+	if err != nil {
+		return err
+	}
+
+	// Resolve the WiFi settings up front, so we don't start flashing
+	// if some of them are wrong. Only ask for the default WiFi settings
+	// if some of the devices need them.
+	var defaultWifi *wifiConfig
+	wifis := map[*batchEntry]*wifiConfig{}
+	for _, entry := range entries {
+		var wifi *wifiConfig
+		switch {
+		case entry.WifiProfile != "":
+			if wifi, err = getWifiProfile(entry.WifiProfile); err != nil {
+				return err
+			}
+		case entry.WifiSSID != "":
+			wifi = &wifiConfig{Networks: []wifiNetwork{{SSID: entry.WifiSSID, Password: entry.WifiPassword}}}
+		default:
+			if defaultWifi == nil {
+				if defaultWifi, err = getWifiConfig(cmd); err != nil {
+					return err
+				}
+			}
+			wifi = defaultWifi
+		}
+		wifis[entry] = wifi
+	}
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listener, err := listenForIdentify(listenCtx, scanPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for devices: %w", err)
+	}
+
+	fmt.Printf("Flashing %d devices, %d at a time ...\n", len(entries), jobs)
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, jobs)
+	for _, entry := range entries {
+		id := uuid.New()
+		entry.ID = id.String()
+		if entry.Name == "" {
+			entry.Name = GetRandomName(id[:])
+		}
+		if entry.Chip == "" {
+			entry.Chip = defaultChip
+		}
+		entry.USBSerial = usbSerialNumber(entry.Port)
+
+		wg.Add(1)
+		go func(entry *batchEntry, wifi *wifiConfig) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			err := flashDevice(ctx, cmd, entry.Port, entry.Chip, int(baud), entry.ID, entry.Name, wifi, true)
+			<-semaphore
+			if err != nil {
+				entry.Status = batchStatusFlashFailed
+				entry.Error = err.Error()
+				fmt.Printf("[%s] Failed to flash '%s': %v\n", entry.Port, entry.Name, err)
+				return
+			}
+			fmt.Printf("[%s] Flashed '%s', waiting for it to show up on the network ...\n", entry.Port, entry.Name)
+
+			waitCtx, cancel := context.WithTimeout(ctx, identifyTimeout)
+			defer cancel()
+			dev, err := listener.waitFor(waitCtx, entry.ID)
+			if err != nil {
+				entry.Status = batchStatusNotIdentified
+				entry.Error = fmt.Sprintf("device did not show up on the network within %s", identifyTimeout)
+				fmt.Printf("[%s] '%s' did not show up on the network\n", entry.Port, entry.Name)
+				return
+			}
+			entry.Address = dev.Address
+			entry.Status = batchStatusOK
+			fmt.Printf("[%s] '%s' is up at %s\n", entry.Port, entry.Name, dev.Address)
+		}(entry, wifis[entry])
+	}
+	wg.Wait()
+
+	failed := 0
+	portLength, nameLength := len("PORT"), len("NAME")
+	for _, entry := range entries {
+		portLength = max(portLength, len(entry.Port))
+		nameLength = max(nameLength, len(entry.Name))
+		if entry.Status != batchStatusOK {
+			failed++
+		}
+	}
+	fmt.Println()
+	fmt.Println(padded("PORT", portLength) + padded("NAME", nameLength) + padded("ID", 36) + "STATUS")
+	for _, entry := range entries {
+		fmt.Println(padded(entry.Port, portLength) + padded(entry.Name, nameLength) + padded(entry.ID, 36) + entry.Status)
+	}
+
+	if reportPath != "" {
+		if err := writeBatchReport(reportPath, entries); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote report to '%s'\n", reportPath)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(entries))
+	}
+	return nil
+}
+
+// writeReport writes the entries as JSON if the path ends in '.json' and
+// otherwise writes the rows as CSV.
+func writeReport(path string, entries interface{}, header []string, rows [][]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	writer := csv.NewWriter(file)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	return writer.Error()
+}
+
+func writeBatchReport(path string, entries []*batchEntry) error {
+	var rows [][]string
+	for _, entry := range entries {
+		rows = append(rows, []string{entry.Port, entry.USBSerial, entry.ID, entry.Name, entry.Address, entry.Status, entry.Error})
+	}
+	return writeReport(path, entries, []string{"port", "usb-serial", "id", "name", "address", "status", "error"}, rows)
+}
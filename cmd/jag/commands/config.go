@@ -136,6 +136,7 @@ func ConfigWifiCmd() *cobra.Command {
 	setCmd.MarkFlagRequired("wifi-ssid")
 	setCmd.MarkFlagRequired("wifi-password")
 	cmd.AddCommand(setCmd)
+	cmd.AddCommand(ConfigWifiProfileCmd())
 	return cmd
 }
 
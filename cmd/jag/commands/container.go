@@ -115,6 +115,11 @@ func ContainerInstallCmd() *cobra.Command {
 				return err
 			}
 
+			device, err = checkSDKVersion(cmd, cfg, sdk, device)
+			if err != nil {
+				return err
+			}
+
 			name := args[0]
 			defines, err := parseDefineFlags(cmd, "define")
 			if err != nil {
@@ -127,6 +132,7 @@ func ContainerInstallCmd() *cobra.Command {
 
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control container on device")
+	addUpdateFirmwareFlag(cmd)
 	return cmd
 }
 
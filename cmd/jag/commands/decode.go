@@ -6,13 +6,17 @@ package commands
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/mitchellh/mapstructure"
@@ -30,23 +34,23 @@ func DecodeCmd() *cobra.Command {
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return serialDecode(cmd, args[0])
+			return serialDecode(cmd, args[0], os.Stdout)
 		},
 	}
 	return cmd
 }
 
-func serialDecode(cmd *cobra.Command, message string) error {
+func serialDecode(cmd *cobra.Command, message string, out io.Writer) error {
 	if strings.HasPrefix(message, "jag decode ") {
-		return jagDecode(cmd, message[11:])
+		return jagDecode(cmd, message[11:], out)
 	} else if strings.HasPrefix(message, "Backtrace:") {
-		return crashDecode(cmd, message)
+		return crashDecode(cmd, message, out)
 	} else {
-		return jagDecode(cmd, message)
+		return jagDecode(cmd, message, out)
 	}
 }
 
-func jagDecode(cmd *cobra.Command, base64Message string) error {
+func jagDecode(cmd *cobra.Command, base64Message string, out io.Writer) error {
 	ctx := cmd.Context()
 	sdk, err := GetSDK(ctx)
 	if err != nil {
@@ -141,11 +145,11 @@ func jagDecode(cmd *cobra.Command, base64Message string) error {
 
 	decodeCommand := sdk.SystemMessage(ctx, snapshot, "-b", base64Message)
 	decodeCommand.Stderr = os.Stderr
-	decodeCommand.Stdout = os.Stdout
+	decodeCommand.Stdout = out
 	return decodeCommand.Run()
 }
 
-func crashDecode(cmd *cobra.Command, backtrace string) error {
+func crashDecode(cmd *cobra.Command, backtrace string, out io.Writer) error {
 	ctx := cmd.Context()
 	sdk, err := GetSDK(ctx)
 	if err != nil {
@@ -167,15 +171,59 @@ func crashDecode(cmd *cobra.Command, backtrace string) error {
 	}
 	stacktraceCommand := sdk.Stacktrace(ctx, "--objdump", objdump, "--backtrace", backtrace, elf)
 	stacktraceCommand.Stderr = os.Stderr
-	stacktraceCommand.Stdout = os.Stdout
-	fmt.Println("Crash in native code:")
-	fmt.Println(backtrace)
+	stacktraceCommand.Stdout = out
+	fmt.Fprintln(out, "Crash in native code:")
+	fmt.Fprintln(out, backtrace)
 	return stacktraceCommand.Run()
 }
 
 type Decoder struct {
 	scanner *bufio.Scanner
 	cmd     *cobra.Command
+	// If set, every line printed by the decoder gets this prefix. Used to
+	// tell the output of several devices apart.
+	prefix string
+	// The name of the device (or simulator) that produced the output.
+	device string
+	// If set, every line is also parsed into a structured log event and
+	// handed to this sink.
+	events logEventSink
+	// If set, the decoder does not print anything and only produces log
+	// events.
+	quiet bool
+	// If set, every line starts with its age as sent by 'jag logs'.
+	withAge bool
+	// When the line being decoded was printed.
+	lineTime time.Time
+}
+
+// Decoders running concurrently share the standard output, so we make
+// sure that the lines of decoded stack traces are not interleaved.
+var decodeMutex sync.Mutex
+
+func (d *Decoder) println(lines ...string) {
+	for _, line := range lines {
+		if !d.quiet {
+			fmt.Println(d.prefix + line)
+		}
+		d.emit(ParseLogLine(line))
+	}
+}
+
+func (d *Decoder) emit(event LogEvent) {
+	if d.events == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = d.lineTime
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Device = d.device
+	if err := d.events.Emit(event); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to emit log event:", err)
+	}
 }
 
 func (d *Decoder) decode() {
@@ -192,6 +240,10 @@ func (d *Decoder) decode() {
 	for d.scanner.Scan() {
 		// Get next line from device (or simulator) console.
 		line := d.scanner.Text()
+		d.lineTime = time.Now()
+		if d.withAge {
+			d.lineTime, line = splitLogAge(line, d.lineTime)
+		}
 		versionPrefix := "[toit] INFO: starting <v"
 		if strings.HasPrefix(line, versionPrefix) && strings.HasSuffix(line, ">") {
 			Version = line[len(versionPrefix) : len(line)-1]
@@ -201,28 +253,49 @@ func (d *Decoder) decode() {
 		} else {
 			separator := strings.Repeat("*", 78)
 			if strings.HasPrefix(line, "jag decode ") || strings.HasPrefix(line, "Backtrace:") {
-				fmt.Printf("\n" + separator + "\n")
-				if Version != "" {
-					fmt.Printf("Decoded by `jag` <%s>\n", Version)
-					fmt.Printf(separator + "\n")
+				// Keep a copy of the decoded stack trace, so we can emit it
+				// as a single log event.
+				var decoded bytes.Buffer
+				out := io.Writer(&decoded)
+				decodeMutex.Lock()
+				if !d.quiet {
+					out = io.MultiWriter(os.Stdout, &decoded)
+					fmt.Printf("\n" + separator + "\n")
+					if d.prefix != "" {
+						fmt.Printf("Stack trace from %s\n", strings.TrimSpace(d.prefix))
+					}
+					if Version != "" {
+						fmt.Printf("Decoded by `jag` <%s>\n", Version)
+						fmt.Printf(separator + "\n")
+					}
 				}
-				if err := serialDecode(d.cmd, line); err != nil {
+				if err := serialDecode(d.cmd, line, out); err != nil {
 					if len(postponed) != 0 {
-						fmt.Println(strings.Join(postponed, "\n"))
+						d.println(postponed...)
 						postponed = []string{}
 					}
-					fmt.Println(line)
-					fmt.Println("jag: Failed to decode line.")
+					d.println(line)
+					if !d.quiet {
+						fmt.Println("jag: Failed to decode line.")
+					}
 				} else {
 					postponed = []string{}
+					d.emit(LogEvent{
+						Name:    "jag",
+						Level:   "ERROR",
+						Message: strings.TrimSpace(decoded.String()),
+					})
+				}
+				if !d.quiet {
+					fmt.Printf(separator + "\n\n")
 				}
-				fmt.Printf(separator + "\n\n")
+				decodeMutex.Unlock()
 			} else {
 				if len(postponed) != 0 {
-					fmt.Println(strings.Join(postponed, "\n"))
+					d.println(postponed...)
 					postponed = []string{}
 				}
-				fmt.Println(line)
+				d.println(line)
 			}
 		}
 	}
@@ -12,10 +12,15 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -23,6 +28,9 @@ const (
 	JaguarSDKVersionHeader    = "X-Jaguar-SDK-Version"
 	JaguarDefinesHeader       = "X-Jaguar-Defines"
 	JaguarContainerNameHeader = "X-Jaguar-Container-Name"
+	JaguarLogsFollowHeader    = "X-Jaguar-Logs-Follow"
+	JaguarLogsAgeHeader       = "X-Jaguar-Logs-Age"
+	JaguarDeviceNameHeader    = "X-Jaguar-Device-Name"
 )
 
 type Devices struct {
@@ -43,6 +51,7 @@ type Device struct {
 	Address    string `mapstructure:"address" yaml:"address" json:"address"`
 	SDKVersion string `mapstructure:"sdkVersion" yaml:"sdkVersion" json:"sdkVersion"`
 	WordSize   int    `mapstructure:"wordSize" yaml:"wordSize" json:"wordSize"`
+	Chip       string `mapstructure:"chip" yaml:"chip,omitempty" json:"chip,omitempty"`
 }
 
 func (d Device) String() string {
@@ -75,6 +84,38 @@ func (d Device) Ping(ctx context.Context, sdk *SDK) bool {
 	return res.StatusCode == http.StatusOK
 }
 
+// Identify asks the device how it currently identifies itself. Unlike the
+// device as stored at scan time, the answer reflects the firmware that is
+// on the device right now.
+func (d Device) Identify(ctx context.Context) (*Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/identify", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	identity, err := parseDevice(body)
+	if err != nil {
+		return nil, err
+	} else if identity == nil {
+		return nil, fmt.Errorf("invalid identify response")
+	}
+	return identity, nil
+}
+
 func (d Device) SendCode(ctx context.Context, sdk *SDK, request string, b []byte, name string, defines string) error {
 	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+request, bytes.NewReader(b))
 	if err != nil {
@@ -152,6 +193,147 @@ func (d Device) ContainerUninstall(ctx context.Context, sdk *SDK, name string) e
 	return nil
 }
 
+// Rename changes the name stored on the device. The device announces
+// itself with the new name right away.
+func (d Device) Rename(ctx context.Context, sdk *SDK, name string) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/rename", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	req.Header.Set(JaguarDeviceNameHeader, name)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	return d.checkStatusOK(body, "renaming")
+}
+
+// Reboot restarts the device.
+func (d Device) Reboot(ctx context.Context, sdk *SDK) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/reboot", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNotImplemented {
+		return fmt.Errorf("'%s' cannot be rebooted remotely", d.Name)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	return d.checkStatusOK(body, "rebooting")
+}
+
+// Status returns the health of the device and the containers on it.
+func (d Device) Status(ctx context.Context, sdk *SDK) (*DeviceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	if len(body) == 0 {
+		return nil, d.unsupportedError("status")
+	}
+
+	var status DeviceStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse the status of '%s': %w", d.Name, err)
+	}
+	return &status, nil
+}
+
+// checkStatusOK checks that the response is the status the device sends
+// when it has handled a request. Older firmware silently ignores requests
+// it doesn't know.
+func (d Device) checkStatusOK(body []byte, feature string) error {
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil || status.Status != "OK" {
+		return d.unsupportedError(feature)
+	}
+	return nil
+}
+
+func (d Device) unsupportedError(feature string) error {
+	return fmt.Errorf("the firmware on '%s' does not support %s, use 'jag firmware update' first", d.Name, feature)
+}
+
+// LogStream is the console output of a device as returned by Logs.
+type LogStream struct {
+	io.ReadCloser
+	// If set, every line starts with how many microseconds ago the device
+	// printed it. Older firmware doesn't send the ages.
+	withAge bool
+}
+
+// Logs returns a stream of the console output of the device. Without
+// follow, the stream ends after the output buffered on the device. With
+// follow, the device keeps the stream open and sends new output as it
+// is printed.
+func (d Device) Logs(ctx context.Context, sdk *SDK, follow bool) (*LogStream, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/logs", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	if follow {
+		req.Header.Set(JaguarLogsFollowHeader, "true")
+	}
+	req.Header.Set(JaguarLogsAgeHeader, "true")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		io.ReadAll(res.Body) // Avoid closing connection prematurely.
+		res.Body.Close()
+		return nil, fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	return &LogStream{
+		ReadCloser: res.Body,
+		withAge:    res.Header.Get(JaguarLogsAgeHeader) == "true",
+	}, nil
+}
+
 // A Reader based on a byte array that prints a progress bar.
 type ProgressReader struct {
 	b         []byte
@@ -205,8 +387,13 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 	return copied, nil
 }
 
-func (d Device) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error {
-	var reader = NewProgressReader(b)
+// UpdateFirmware sends new firmware to the device. Unless quiet is set,
+// a progress bar is shown while sending.
+func (d Device) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte, quiet bool) error {
+	var reader io.Reader = NewProgressReader(b)
+	if quiet {
+		reader = bytes.NewReader(b)
+	}
 	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/firmware", reader)
 	if err != nil {
 		return err
@@ -214,7 +401,9 @@ func (d Device) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error {
 	req.ContentLength = int64(len(b))
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	defer fmt.Print("\n\n")
+	if !quiet {
+		defer fmt.Print("\n\n")
+	}
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -261,3 +450,336 @@ func GetDevice(ctx context.Context, cfg *viper.Viper, sdk *SDK, checkPing bool,
 	}
 	return d, nil
 }
+
+// GetDevices finds the devices for a list of device selections. Without
+// any selections, it falls back to the device picked by GetDevice.
+func GetDevices(ctx context.Context, cfg *viper.Viper, sdk *SDK, checkPing bool, deviceSelects []deviceSelect) ([]*Device, error) {
+	if len(deviceSelects) == 0 {
+		d, err := GetDevice(ctx, cfg, sdk, checkPing, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*Device{d}, nil
+	}
+
+	var res []*Device
+	for _, ds := range deviceSelects {
+		d, err := GetDevice(ctx, cfg, sdk, checkPing, ds)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+func DeviceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "device",
+		Short: "Manage a Jaguar device over WiFi",
+	}
+
+	cmd.AddCommand(DeviceRenameCmd())
+	cmd.AddCommand(DeviceRebootCmd())
+	cmd.AddCommand(DeviceStatusCmd())
+	return cmd
+}
+
+func DeviceRenameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rename <new-name>",
+		Short: "Change the name of a Jaguar device",
+		Long: "Change the name of a Jaguar device via WiFi without reflashing it. The name\n" +
+			"is stored on the device together with its id. 'jag firmware update' gives the\n" +
+			"device a new id, but it puts the current name into the new firmware, so the\n" +
+			"name survives the update. Flashing the device with 'jag flash' replaces it.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if err := validateDeviceName(name); err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			if err := device.Rename(ctx, sdk, name); err != nil {
+				return err
+			}
+			fmt.Printf("Renamed '%s' to '%s'\n", device.Name, name)
+
+			oldName := device.Name
+			device.Name = name
+			if err := updateStoredDevice(cfg, device.ID, device); err != nil {
+				return err
+			}
+			if s, ok := deviceSelect.(deviceNameSelect); ok && string(s) == oldName {
+				fmt.Printf("Use '-d %s' to select the device from now on.\n", name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	return cmd
+}
+
+// validateDeviceName checks that a name can be used for a device and
+// that it will be picked up as a name by '-d'.
+func validateDeviceName(name string) error {
+	const maxLength = 64
+	if name == "" {
+		return fmt.Errorf("the device name cannot be empty")
+	}
+	if len(name) > maxLength {
+		return fmt.Errorf("the device name cannot be longer than %d bytes", maxLength)
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("the device name cannot start or end with whitespace")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("the device name cannot contain control characters")
+		}
+	}
+	if name == "host" {
+		return fmt.Errorf("'host' is reserved for running on this computer")
+	}
+	if _, ok := parseDeviceSelection(name).(deviceNameSelect); !ok {
+		return fmt.Errorf("'%s' looks like an id or an address and cannot be used as a name", name)
+	}
+	return nil
+}
+
+// DeviceStatus is the health of a device as reported by the device.
+type DeviceStatus struct {
+	Name       string `json:"name" yaml:"name"`
+	ID         string `json:"id" yaml:"id"`
+	SDKVersion string `json:"sdkVersion" yaml:"sdkVersion"`
+	Chip       string `json:"chip,omitempty" yaml:"chip,omitempty"`
+	// The time since the last reset in seconds.
+	Uptime int64 `json:"uptime" yaml:"uptime"`
+	Memory struct {
+		Free        int64 `json:"free" yaml:"free"`
+		LargestFree int64 `json:"largestFree" yaml:"largestFree"`
+	} `json:"memory" yaml:"memory"`
+	// The bytes of flash used by the installed containers.
+	FlashUsed int64 `json:"flashUsed" yaml:"flashUsed"`
+	// The signal strength of the WiFi network in dBm, if known.
+	RSSI        *int                    `json:"rssi,omitempty" yaml:"rssi,omitempty"`
+	ResetReason string                  `json:"resetReason,omitempty" yaml:"resetReason,omitempty"`
+	Containers  []DeviceContainerStatus `json:"containers" yaml:"containers"`
+}
+
+type DeviceContainerStatus struct {
+	// The name is empty for programs started with 'jag run'.
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	ID      string `json:"id" yaml:"id"`
+	Size    *int64 `json:"size,omitempty" yaml:"size,omitempty"`
+	Running bool   `json:"running" yaml:"running"`
+}
+
+func (s *DeviceStatus) print() {
+	fmt.Printf("Device:       %s (%s)\n", s.Name, s.ID)
+	fmt.Printf("SDK version:  %s\n", s.SDKVersion)
+	if s.Chip != "" {
+		fmt.Printf("Chip:         %s\n", s.Chip)
+	}
+	fmt.Printf("Uptime:       %s\n", time.Duration(s.Uptime)*time.Second)
+	if s.ResetReason != "" {
+		fmt.Printf("Last reset:   %s\n", s.ResetReason)
+	}
+	fmt.Printf("Free memory:  %dKB (largest block %dKB)\n", s.Memory.Free/1024, s.Memory.LargestFree/1024)
+	fmt.Printf("Flash used:   %dKB by installed containers\n", s.FlashUsed/1024)
+	if s.RSSI != nil {
+		fmt.Printf("WiFi RSSI:    %d dBm\n", *s.RSSI)
+	}
+
+	fmt.Println()
+	nameLength, idLength := len("NAME"), len("IMAGE")
+	for _, c := range s.Containers {
+		nameLength = max(nameLength, len(c.Name))
+		idLength = max(idLength, len(c.ID))
+	}
+	fmt.Println(padded("NAME", nameLength) + padded("IMAGE", idLength) + padded("SIZE", 8) + "STATE")
+	for _, c := range s.Containers {
+		name := c.Name
+		if name == "" {
+			name = "(program)"
+		}
+		size := "-"
+		if c.Size != nil {
+			size = fmt.Sprintf("%dKB", *c.Size/1024)
+		}
+		state := "stopped"
+		if c.Running {
+			state = "running"
+		}
+		fmt.Println(padded(name, nameLength) + padded(c.ID, idLength) + padded(size, 8) + state)
+	}
+}
+
+func DeviceStatusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the health of a Jaguar device",
+		Long: "Show the uptime, free memory, flash usage, WiFi signal strength and reason\n" +
+			"for the last reset of a Jaguar device together with its containers.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			status, err := device.Status(ctx, sdk)
+			if err != nil {
+				return err
+			}
+
+			switch strings.ToLower(output) {
+			case "json":
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(status)
+			case "yaml":
+				return yaml.NewEncoder(os.Stdout).Encode(status)
+			case "short":
+				status.print()
+				return nil
+			default:
+				return fmt.Errorf("--output flag '%s' was not recognized. Must be either json, yaml or short.", output)
+			}
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().StringP("output", "o", "short", "Set output format to json, yaml or short")
+	return cmd
+}
+
+func DeviceRebootCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reboot",
+		Short: "Reboot a Jaguar device",
+		Long: "Reboot a Jaguar device via WiFi. Installed containers are started again when\n" +
+			"the device boots, but the program started with 'jag run' is not.\n\n" +
+			"'jag device status' reports the last reset of a rebooted device as\n" +
+			"'jag device reboot'.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			wait, err := cmd.Flags().GetBool("wait")
+			if err != nil {
+				return err
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			if err := device.Reboot(ctx, sdk); err != nil {
+				return err
+			}
+			fmt.Printf("Rebooting '%s'\n", device.Name)
+			if !wait {
+				return nil
+			}
+
+			// Wait for the device to go down before listening for it, so
+			// we don't mistake the last announcements before the reboot
+			// for the device being back.
+			waitCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			for device.Ping(waitCtx, sdk) {
+				select {
+				case <-waitCtx.Done():
+					return fmt.Errorf("'%s' did not reboot within %s", device.Name, timeout)
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+
+			listener, err := listenForIdentify(waitCtx, scanPort)
+			if err != nil {
+				return fmt.Errorf("failed to listen for devices: %w", err)
+			}
+			back, err := listener.waitFor(waitCtx, device.ID)
+			if err != nil {
+				return fmt.Errorf("'%s' did not come back within %s", device.Name, timeout)
+			}
+			fmt.Printf("'%s' is back at %s\n", back.Name, back.Address)
+			if back.Address != device.Address {
+				return updateStoredDevice(cfg, device.ID, back)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().Bool("wait", true, "wait for the device to come back after rebooting")
+	cmd.Flags().Duration("timeout", time.Minute, "how long to wait for the device to come back")
+	return cmd
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Diagnostic is an error or a warning reported by the Toit compiler.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// The compiler reports every diagnostic on a line of its own, followed by
+// the source line and a marker for the column.
+var diagnosticPattern = regexp.MustCompile(`^(.+):(\d+):(\d+): (error|warning|note|information): (.*)$`)
+
+// parseDiagnostics finds the diagnostics in the output of the compiler.
+func parseDiagnostics(output []byte) []Diagnostic {
+	var res []Diagnostic
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := diagnosticPattern.FindStringSubmatch(strings.TrimRight(scanner.Text(), "\r"))
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		column, _ := strconv.Atoi(m[3])
+		res = append(res, Diagnostic{
+			File:     m[1],
+			Line:     line,
+			Column:   column,
+			Severity: m[4],
+			Message:  m[5],
+		})
+	}
+	return res
+}
+
+// compileError is returned when the compiler rejects a program. The
+// diagnostics have already been printed when it is returned.
+type compileError struct {
+	path        string
+	diagnostics []Diagnostic
+}
+
+func (e *compileError) Error() string {
+	errors := 0
+	for _, d := range e.diagnostics {
+		if d.Severity == "error" {
+			errors++
+		}
+	}
+	switch errors {
+	case 0:
+		return fmt.Sprintf("failed to compile '%s'", e.path)
+	case 1:
+		return fmt.Sprintf("failed to compile '%s' (1 error)", e.path)
+	}
+	return fmt.Sprintf("failed to compile '%s' (%d errors)", e.path, errors)
+}
+
+func addDiagnosticsFlag(cmd *cobra.Command) {
+	cmd.Flags().String("diagnostics", "text", "print compiler errors and warnings as text or as json lines with one diagnostic per line")
+}
+
+// diagnosticsFormat returns the format of the compiler diagnostics given
+// to the command. Commands without the flag print them as text.
+func diagnosticsFormat(cmd *cobra.Command) (string, error) {
+	if cmd.Flags().Lookup("diagnostics") == nil {
+		return "text", nil
+	}
+	format, err := cmd.Flags().GetString("diagnostics")
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(format) {
+	case "text":
+		return "text", nil
+	case "json":
+		return "json", nil
+	}
+	return "", fmt.Errorf("--diagnostics flag '%s' was not recognized. Must be either text or json.", format)
+}
+
+// printDiagnostics prints the output of the compiler in the format given
+// to the command.
+func printDiagnostics(cmd *cobra.Command, output []byte) error {
+	format, err := diagnosticsFormat(cmd)
+	if err != nil {
+		return err
+	}
+	if format == "text" {
+		_, err := os.Stdout.Write(output)
+		return err
+	}
+
+	diagnostics := parseDiagnostics(output)
+	if len(diagnostics) == 0 && len(bytes.TrimSpace(output)) != 0 {
+		// Not a diagnostic, so we don't hide it.
+		_, err := os.Stderr.Write(output)
+		return err
+	}
+	for _, d := range diagnostics {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// expressionProgram returns a program that imports the modules, evaluates
+// the expression and prints its value. The lines printed by the program
+// start with the marker, so we can find them in the output of the device.
+func expressionProgram(expression string, imports []string, marker string) string {
+	lines := strings.Split(strings.TrimSpace(expression), "\n")
+	for i, line := range lines {
+		lines[i] = "      " + strings.TrimRight(line, "\r")
+	}
+	importLines := ""
+	for _, module := range imports {
+		importLines += "import " + strings.TrimSpace(module) + "\n"
+	}
+	if importLines != "" {
+		importLines += "\n"
+	}
+	return fmt.Sprintf(`// Generated by 'jag run -s' to evaluate an expression on a device.
+
+%[3]smain:
+  print "%[1]s:start"
+  exception := catch --trace:
+    result := (
+%[2]s
+    )
+    print "%[1]s=$result"
+  print (exception ? "%[1]s:failed" : "%[1]s:done")
+`, marker, strings.Join(lines, "\n"), importLines)
+}
+
+// RunExpression evaluates the expression on the device and prints its
+// value. Everything else the program prints, like stack traces, is shown
+// too.
+func RunExpression(cmd *cobra.Command, device *Device, sdk *SDK, expression string, imports []string, defines string) error {
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+
+	tempdir, err := ioutil.TempDir("", "jag_expression")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempdir)
+
+	// Every evaluation has its own marker, so we don't mistake the output
+	// of an earlier evaluation for the value.
+	marker := "jag-expression-" + uuid.New().String()
+	entrypoint := filepath.Join(tempdir, "expression.toit")
+	program := expressionProgram(expression, imports, marker)
+	if err := os.WriteFile(entrypoint, []byte(program), 0644); err != nil {
+		return err
+	}
+
+	snapshot, err := compileSnapshot(cmd, sdk, entrypoint, defines, false)
+	if _, ok := err.(*compileError); ok {
+		// The diagnostics point into the generated program, which is
+		// removed when we return, so we show it.
+		fmt.Fprintf(os.Stderr, "The expression was compiled as part of '%s':\n", entrypoint)
+		for i, line := range strings.Split(strings.TrimRight(program, "\n"), "\n") {
+			fmt.Fprintf(os.Stderr, "%4d  %s\n", i+1, line)
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// We start following the output before running the program, so we
+	// don't miss any of it.
+	stream, err := device.Logs(ctx, sdk, true)
+	if err != nil {
+		return fmt.Errorf("can't show the value, because the output of '%s' can't be streamed: %w", device.Name, err)
+	}
+	defer stream.Close()
+
+	if err := RunSnapshot(cmd, device, sdk, expression, snapshot, defines); err != nil {
+		return err
+	}
+
+	outReader, outWriter := io.Pipe()
+	decoded := make(chan struct{})
+	go func() {
+		defer close(decoded)
+		scanner := bufio.NewScanner(outReader)
+		decoder := (&logOutput{}).newDecoder(scanner, cmd, device.Name, "")
+		decoder.decode()
+	}()
+	defer func() {
+		outWriter.Close()
+		<-decoded
+	}()
+
+	started := false
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if stream.withAge {
+			_, line = splitLogAge(line, time.Time{})
+		}
+		switch {
+		case line == marker+":start":
+			started = true
+		case !started:
+			// Output from before the program started.
+		case strings.HasPrefix(line, marker+"="):
+			fmt.Fprintln(outWriter, strings.TrimPrefix(line, marker+"="))
+		case line == marker+":done":
+			return nil
+		case line == marker+":failed":
+			return fmt.Errorf("evaluating '%s' on '%s' failed", expression, device.Name)
+		default:
+			fmt.Fprintln(outWriter, line)
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("lost the output of '%s': %w", device.Name, err)
+	}
+	return fmt.Errorf("the output of '%s' ended before '%s' was evaluated", device.Name, expression)
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpressionProgram(t *testing.T) {
+	program := expressionProgram("foo\r\n  .bar", []string{"gpio", " encoding.json show encode "}, "marker")
+	lines := strings.Split(program, "\n")
+	if lines[2] != "import gpio" || lines[3] != "import encoding.json show encode" || lines[4] != "" {
+		t.Errorf("the imports are not at the top of the program:\n%s", program)
+	}
+	if !strings.Contains(program, "\n      foo\n        .bar\n") {
+		t.Errorf("the expression is not indented into main:\n%s", program)
+	}
+
+	program = expressionProgram("42", nil, "marker")
+	if strings.Contains(program, "import") {
+		t.Errorf("the program has imports:\n%s", program)
+	}
+	if !strings.Contains(program, "\n\nmain:\n") {
+		t.Errorf("main doesn't follow the header:\n%s", program)
+	}
+}
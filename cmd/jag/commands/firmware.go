@@ -12,19 +12,32 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
 )
 
 type binaryConfig struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+	// Images built for many devices have no name and no id. The device
+	// then creates its id on the first boot and derives its name from it.
+	Name string `json:"name,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Chip string `json:"chip"`
+	// The first network is also stored here, where the WiFi service of the
+	// firmware looks for it.
 	Wifi struct {
 		Password string `json:"wifi.password"`
 		SSID     string `json:"wifi.ssid"`
 	} `json:"wifi"`
+	Networks []binaryWifiNetwork `json:"networks,omitempty"`
+}
+
+type binaryWifiNetwork struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
 }
 
 func FirmwareCmd() *cobra.Command {
@@ -33,7 +46,9 @@ func FirmwareCmd() *cobra.Command {
 		Short: "Show or update firmware for a Jaguar device",
 		Long: "Without the 'update' command show the firmware version for a Jaguar device.\n" +
 			"The device reports the version information when it responds to pings.\n\n" +
-			"With the 'update' command update the firmware of a Jaguar device via WiFi.",
+			"With the 'update' command update the firmware of a Jaguar device via WiFi.\n\n" +
+			"With the 'build' command build a complete flash image for flashing devices\n" +
+			"with other tools and with the 'inspect' command show what is in an image.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -58,11 +73,17 @@ func FirmwareCmd() *cobra.Command {
 				return err
 			}
 
-			fmt.Printf("Device '%s' is running Toit SDK %s\n", device.Name, device.SDKVersion)
+			if device.Chip != "" {
+				fmt.Printf("Device '%s' (%s) is running Toit SDK %s\n", device.Name, device.Chip, device.SDKVersion)
+			} else {
+				fmt.Printf("Device '%s' is running Toit SDK %s\n", device.Name, device.SDKVersion)
+			}
 			return nil
 		},
 	}
 	cmd.AddCommand(FirmwareUpdateCmd())
+	cmd.AddCommand(FirmwareBuildCmd())
+	cmd.AddCommand(FirmwareInspectCmd())
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	return cmd
 }
@@ -72,7 +93,12 @@ func FirmwareUpdateCmd() *cobra.Command {
 		Use:   "update",
 		Short: "Update the firmware on a Jaguar device",
 		Long: "Update the firmware on a Jaguar device via WiFi. The device name and\n" +
-			"id are preserved across the operation.",
+			"id are preserved across the operation.\n\n" +
+			"With '--all', '--match' or more than one '-d' the firmware is rolled out to\n" +
+			"many devices in waves. The first wave only has the canary devices and the\n" +
+			"following waves each have a percentage of the devices. Every device must come\n" +
+			"back with the new SDK version before the next wave starts, and the rollout\n" +
+			"stops when too many devices fail.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -82,43 +108,46 @@ func FirmwareUpdateCmd() *cobra.Command {
 			}
 
 			ctx := cmd.Context()
-			deviceSelect, err := parseDeviceFlag(cmd)
+			deviceSelects, err := parseDevicesFlag(cmd)
 			if err != nil {
 				return err
 			}
 
-			sdk, err := GetSDK(ctx)
+			all, err := cmd.Flags().GetBool("all")
 			if err != nil {
 				return err
 			}
 
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
 			}
 
-			wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
+			wifi, err := getWifiConfig(cmd)
 			if err != nil {
 				return err
 			}
 
-			// We need to generate a new ID for the device, so entries in
-			// the device flash stored by an older version are invalidated.
-			newID := uuid.New().String()
+			if all || cmd.Flags().Changed("match") || len(deviceSelects) > 1 {
+				return rolloutFirmware(cmd, cfg, sdk, wifi, deviceSelects)
+			}
 
-			binTmpFile, err := BuildFirmwareImage(ctx, newID, device.Name, wifiSSID, wifiPassword)
+			var deviceSelect deviceSelect
+			if len(deviceSelects) == 1 {
+				deviceSelect = deviceSelects[0]
+			}
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
 			if err != nil {
 				return err
 			}
-			defer os.Remove(binTmpFile.Name())
 
-			bin, err := ioutil.ReadFile(binTmpFile.Name())
+			bin, newID, chip, err := buildFirmwareForDevice(ctx, device, wifi)
 			if err != nil {
 				return err
 			}
 
 			fmt.Printf("Updating firmware on '%s' to Toit SDK %s\n\n", device.Name, sdk.Version)
-			if err := device.UpdateFirmware(ctx, sdk, bin); err != nil {
+			if err := device.UpdateFirmware(ctx, sdk, bin, false); err != nil {
 				return err
 			}
 
@@ -128,24 +157,169 @@ func FirmwareUpdateCmd() *cobra.Command {
 			// will have to ping again.
 			device.ID = newID
 			device.SDKVersion = sdk.Version
+			device.Chip = chip
 			cfg.Set("device", device)
 			return cfg.WriteConfig()
 		},
 	}
 
-	cmd.Flags().String("wifi-ssid", "", "default WiFi SSID")
-	cmd.Flags().String("wifi-password", "", "default WiFi password")
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	addWifiFlags(cmd)
+	cmd.Flags().StringArrayP("device", "d", nil, "use device with a given name, id, or address (can be repeated)")
+	addRolloutFlags(cmd)
 	return cmd
 }
 
-func BuildFirmwareImage(ctx context.Context, id string, name string, wifiSSID string, wifiPassword string) (*os.File, error) {
+// buildFirmwareForDevice builds a firmware image for updating the device.
+// It returns the image, the new id of the device and its chip.
+func buildFirmwareForDevice(ctx context.Context, device *Device, wifi *wifiConfig) ([]byte, string, string, error) {
+	// We need to generate a new ID for the device, so entries in
+	// the device flash stored by an older version are invalidated.
+	newID := uuid.New().String()
+
+	// Devices flashed by older versions of Jaguar do not report
+	// their chip, but those versions only supported the ESP32.
+	chip := device.Chip
+	if chip == "" {
+		chip = "esp32"
+	}
+	if _, err := firmwareChipByName(chip); err != nil {
+		return nil, "", "", fmt.Errorf("can't update the firmware of '%s': %w", device.Name, err)
+	}
+
+	binTmpFile, err := BuildFirmwareImage(ctx, chip, newID, device.Name, wifi)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer os.Remove(binTmpFile.Name())
+
+	bin, err := ioutil.ReadFile(binTmpFile.Name())
+	if err != nil {
+		return nil, "", "", err
+	}
+	return bin, newID, chip, nil
+}
+
+func FirmwareBuildCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build a complete flash image with the Jaguar firmware",
+		Long: "Build a single flash image that contains the bootloader, the partition table,\n" +
+			"the Jaguar firmware and cleared OTA and NVS data, all at the right offsets.\n" +
+			"The image is meant to be written at offset 0x0 with any flashing tool, for\n" +
+			"instance 'esptool.py write_flash 0x0 factory.bin'.\n\n" +
+			"The image has no device id, so every device flashed with it creates its own\n" +
+			"id on the first boot and is named after it. A name given with '--name' is\n" +
+			"shared by all devices flashed with the image; use 'jag device rename' to\n" +
+			"tell them apart.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return err
+			}
+
+			chipName, err := cmd.Flags().GetString("chip")
+			if err != nil {
+				return err
+			}
+			chip, err := firmwareChipByName(chipName)
+			if err != nil {
+				return err
+			}
+
+			flashSize, err := cmd.Flags().GetString("flash-size")
+			if err != nil {
+				return err
+			}
+			flashSizeBytes := 0
+			if flashSize != "" {
+				size, err := esploader.ParseFlashSize(flashSize)
+				if err != nil {
+					return err
+				}
+				flashSizeBytes = int(size)
+			}
+
+			name, err := cmd.Flags().GetString("name")
+			if err != nil {
+				return err
+			}
+
+			wifi, err := getWifiConfig(cmd)
+			if err != nil {
+				return err
+			}
+
+			table, custom, err := loadPartitionTable(cmd, chip)
+			if err != nil {
+				return err
+			}
+			if err := table.Validate(flashSizeBytes); err != nil {
+				return err
+			}
+
+			binTmpFile, err := BuildFirmwareImage(ctx, chip.Name, "", name, wifi)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(binTmpFile.Name())
+
+			app, err := ioutil.ReadFile(binTmpFile.Name())
+			if err != nil {
+				return err
+			}
+
+			images, err := jaguarImages(chip, table, custom, app)
+			if err != nil {
+				return err
+			}
+
+			merged, err := esploader.MergeImages(chip, images, esploader.FlashOptions{FlashSize: flashSize})
+			if err != nil {
+				return err
+			}
+
+			if err := ioutil.WriteFile(output, merged, 0644); err != nil {
+				return err
+			}
+
+			if name != "" {
+				fmt.Printf("Wrote %s firmware image for devices named '%s' to '%s' (%d bytes)\n", chip.Name, name, output, len(merged))
+			} else {
+				fmt.Printf("Wrote %s firmware image to '%s' (%d bytes)\n", chip.Name, output, len(merged))
+			}
+			for _, image := range images {
+				fmt.Printf("  0x%06x %s\n", image.Offset, image.Name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "factory.bin", "path of the flash image to write")
+	cmd.Flags().String("chip", "esp32", "chip to build the image for ("+strings.Join(esploader.ChipNames(), ", ")+")")
+	cmd.Flags().String("flash-size", "", "flash size to put in the bootloader header (e.g. 4MB), if not set the size of the prebuilt bootloader is kept")
+	addWifiFlags(cmd)
+	cmd.Flags().String("name", "", "name for all devices flashed with the image, if not set each device is named after its id")
+	cmd.Flags().String("partitions", "", "path to a custom partitions.csv (see 'jag partitions')")
+	return cmd
+}
+
+// BuildFirmwareImage builds the firmware for a device with the given id
+// and name. If the id is empty, the device creates its own id when it
+// boots for the first time.
+func BuildFirmwareImage(ctx context.Context, chip string, id string, name string, wifi *wifiConfig) (*os.File, error) {
+	if err := wifi.validate(); err != nil {
+		return nil, err
+	}
+
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	esp32BinPath, err := directory.GetESP32ImagePath()
+	esp32BinPath, err := directory.GetChipImagePath(chip)
 	if err != nil {
 		return nil, err
 	}
@@ -159,8 +333,10 @@ func BuildFirmwareImage(ctx context.Context, id string, name string, wifiSSID st
 	var config binaryConfig
 	config.ID = id
 	config.Name = name
-	config.Wifi.SSID = wifiSSID
-	config.Wifi.Password = wifiPassword
+	config.Chip = chip
+	config.Wifi.SSID = wifi.Networks[0].SSID
+	config.Wifi.Password = wifi.Networks[0].Password
+	config.Networks = wifi.binaryNetworks()
 	if err := json.NewEncoder(configFile).Encode(config); err != nil {
 		configFile.Close()
 		return nil, err
@@ -187,7 +363,13 @@ func BuildFirmwareImage(ctx context.Context, id string, name string, wifiSSID st
 		return nil, err
 	}
 
-	injectCmd := sdk.InjectConfig(ctx, configFile.Name(), "--unique_id", id, binTmpFile.Name())
+	// The unique id identifies the firmware image itself, so images
+	// without a device id need one too.
+	uniqueID := id
+	if uniqueID == "" {
+		uniqueID = uuid.New().String()
+	}
+	injectCmd := sdk.InjectConfig(ctx, configFile.Name(), "--unique_id", uniqueID, binTmpFile.Name())
 	injectCmd.Stderr = os.Stderr
 	injectCmd.Stdout = os.Stdout
 	if err := injectCmd.Run(); err != nil {
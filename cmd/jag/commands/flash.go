@@ -5,105 +5,141 @@
 package commands
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cheggaaa/pb/v3"
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
 )
 
-// Returns position, size of the partitions in partitions.csv.
-func getPartitions(toitToolchainPath string, positions map[string]int, sizes map[string]int) {
-	// Load default partitions positions, that can be overridden by the
-	// partitions.csv file.  Some of these (bootloader, partitions) are
-	// commented out in the partitions.csv because they can't be changed.
-	positions["bootloader"] = 0x1000
-	positions["partitions"] = 0x8000
-	positions["ota"] = 0xd000
-	positions["ota_0"] = 0x10000
-	sizes["bootloader"] = 0x7000
-	sizes["partitions"] = 0x0c00
-	COLUMN_NAME := 0
-	// COLUMN_TYPE := 1
-	COLUMN_SUBTYPE := 2
-	COLUMN_POSITION := 3
-	COLUMN_SIZE := 4
-
-	file, err := os.Open(filepath.Join(toitToolchainPath, "partitions.csv"))
+// zapImage returns an image of zap bytes (0xff) for clearing the partition
+// with the given subtype or name, if the partition table has it.
+func zapImage(table *PartitionTable, key string, name string) (esploader.Image, bool) {
+	p, ok := table.Find(key)
+	if !ok {
+		return esploader.Image{}, false
+	}
+	return esploader.Image{Name: name, Offset: uint32(p.Offset), Data: bytes.Repeat([]byte{0xff}, p.Size)}, true
+}
+
+// hasFirmware returns whether the firmware image and the toolchain files
+// for the chip are installed. 'jag setup' installs them for the ESP32.
+// The other chips have them when their firmware is built in the Toit
+// repository or put into the image cache.
+func hasFirmware(chip *esploader.Chip) bool {
+	imagePath, err := directory.GetChipImagePath(chip.Name)
+	if err != nil {
+		return false
+	}
+	toolchainPath, err := directory.GetChipToolchainPath(chip.Name)
 	if err != nil {
-		panic("Could not find partitions.csv")
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		partitionType := ""
-		line := scanner.Text()
-		comment := strings.Index(line, "#")
-		if comment != -1 {
-			line = line[:comment]
+		return false
+	}
+	for _, p := range []string{
+		filepath.Join(imagePath, "toit.bin"),
+		filepath.Join(imagePath, "bootloader", "bootloader.bin"),
+		filepath.Join(toolchainPath, "partitions.csv"),
+	} {
+		if _, err := os.Stat(p); err != nil {
+			return false
 		}
-		line = strings.TrimSpace(line)
-		if line != "" {
-			fields := strings.Split(line, ",")
-			maxIndex := -1
-			for index, field := range fields {
-				maxIndex = index
-				field = strings.TrimSpace(field)
-				if index == COLUMN_NAME {
-					partitionType = field
-				} else if index == COLUMN_SUBTYPE {
-					if field != "" {
-						partitionType = field
-					}
-				} else if index == COLUMN_POSITION || index == COLUMN_SIZE {
-					num, err := strconv.ParseInt(field, 0, 32)
-					if err != nil || partitionType == "" {
-						panic("Could not parse number in partitions.csv")
-					} else {
-						if index == COLUMN_POSITION {
-							positions[partitionType] = int(num)
-						} else {
-							sizes[partitionType] = int(num)
-						}
-					}
-				}
-			}
-			if maxIndex < COLUMN_SIZE {
-				panic("Could not parse line in partitions.csv (missing fields)")
-			}
+	}
+	return true
+}
+
+// firmwareChipNames returns the names of the chips Jaguar has firmware
+// for.
+func firmwareChipNames() []string {
+	var res []string
+	for _, c := range esploader.Chips {
+		if hasFirmware(c) {
+			res = append(res, c.Name)
 		}
 	}
+	return res
 }
 
-func hex(num int) string {
-	return fmt.Sprintf("0x%x", num)
+// checkFirmwareChip returns an error if the firmware for the chip isn't
+// installed.
+func checkFirmwareChip(chip *esploader.Chip) error {
+	if hasFirmware(chip) {
+		return nil
+	}
+	installed := "none"
+	if names := firmwareChipNames(); len(names) > 0 {
+		installed = strings.Join(names, ", ")
+	}
+	return fmt.Errorf("the Jaguar firmware for the %s is not installed (installed: %s)", chip, installed)
 }
 
-func createZapBytesFile(sizes map[string]int, name string) (*os.File, error) {
-	// Create a file with zap bytes (0xff) for clearing select partitions.
-	zappedDataFile, err := os.CreateTemp("", fmt.Sprint("*.%sdata", name))
+// firmwareChipByName finds a chip Jaguar has firmware for by name.
+func firmwareChipByName(name string) (*esploader.Chip, error) {
+	chip, err := esploader.ChipByName(name)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkFirmwareChip(chip); err != nil {
+		return nil, err
+	}
+	return chip, nil
+}
 
-	if size, ok := sizes[name]; ok {
-		_, err = zappedDataFile.Write(bytes.Repeat([]byte{0xff}, size))
-		if err != nil {
-			os.Remove(zappedDataFile.Name())
-			return nil, err
-		}
+// jaguarImages returns the images that make up a Jaguar installation: the
+// bootloader, the partition table, the application in the ota_0 partition,
+// and zap bytes for the OTA data and the NVS data. Unless the partition
+// table is a custom one, the prebuilt partition table binary is used.
+func jaguarImages(chip *esploader.Chip, table *PartitionTable, custom bool, app []byte) ([]esploader.Image, error) {
+	esp32BinPath, err := directory.GetChipImagePath(chip.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	bootloader, err := os.ReadFile(filepath.Join(esp32BinPath, "bootloader", "bootloader.bin"))
+	if err != nil {
+		return nil, err
+	}
+
+	var partitionTable []byte
+	if custom {
+		partitionTable, err = table.Binary()
 	} else {
-		fmt.Printf("No size for %s partition, skipping\n", name)
+		partitionTable, err = os.ReadFile(filepath.Join(esp32BinPath, "partitions.bin"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ota0, ok := table.Find("ota_0")
+	if !ok {
+		return nil, fmt.Errorf("there is no ota_0 partition in '%s'", table.Source)
+	}
+	if len(app) > ota0.Size {
+		return nil, fmt.Errorf("the firmware is %d bytes, but the ota_0 partition only has room for %d bytes", len(app), ota0.Size)
+	}
+
+	bootloaderPartition, _ := table.Find("bootloader")
+	partitionsPartition, _ := table.Find("partitions")
+	images := []esploader.Image{
+		{Name: "bootloader", Offset: uint32(bootloaderPartition.Offset), Data: bootloader},
+		{Name: "partition table", Offset: uint32(partitionsPartition.Offset), Data: partitionTable},
+		{Name: "Jaguar firmware", Offset: uint32(ota0.Offset), Data: app},
+	}
+	// Force bootloader to boot from OTA 0.
+	if zap, ok := zapImage(table, "ota", "OTA data"); ok {
+		images = append(images, zap)
 	}
-	zappedDataFile.Close()
-	return zappedDataFile, nil
+	if zap, ok := zapImage(table, "nvs", "NVS data"); ok {
+		images = append(images, zap)
+	}
+	return images, nil
 }
 
 func FlashCmd() *cobra.Command {
@@ -112,11 +148,27 @@ func FlashCmd() *cobra.Command {
 		Short: "Flash an ESP32 with the Jaguar image",
 		Long: "Flash an ESP32 with the Jaguar application image. The initial flashing is\n" +
 			"done over a serial connection and it is used to give the ESP32 its initial\n" +
-			"firmware and the necessary WiFi credentials.",
+			"firmware and the necessary WiFi credentials.\n\n" +
+			"With '--batch' many devices are flashed concurrently. The manifest is a CSV\n" +
+			"file with a header row and the columns 'port', 'name', 'wifi-ssid',\n" +
+			"'wifi-password', 'wifi-profile' and 'chip'. Only 'port' is required; devices\n" +
+			"without a name get a generated one and the WiFi settings default to the\n" +
+			"usual ones.\n" +
+			"After flashing, jag waits for each device to announce itself on the network.\n\n" +
+			"Use 'jag flash backup' and 'jag flash restore' to save and restore the\n" +
+			"flash content of a device.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
+			if cmd.Flags().Changed("batch") {
+				manifest, err := cmd.Flags().GetString("batch")
+				if err != nil {
+					return err
+				}
+				return flashBatch(cmd, manifest)
+			}
+
 			port, err := cmd.Flags().GetString("port")
 			if err != nil {
 				return err
@@ -141,78 +193,150 @@ func FlashCmd() *cobra.Command {
 				name = GetRandomName(id[:])
 			}
 
-			wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
+			wifi, err := getWifiConfig(cmd)
 			if err != nil {
 				return err
 			}
 
-			esptoolPath, err := directory.GetEsptoolPath()
+			chipName, err := cmd.Flags().GetString("chip")
 			if err != nil {
 				return err
 			}
 
-			esp32BinPath, err := directory.GetESP32ImagePath()
-			if err != nil {
-				return err
-			}
+			return flashDevice(ctx, cmd, port, chipName, int(baud), id.String(), name, wifi, false)
+		},
+	}
 
-			toitToolchainPath, err := directory.GetToitToolchainPath()
-			if err != nil {
-				return err
-			}
+	cmd.AddCommand(FlashBackupCmd())
+	cmd.AddCommand(FlashRestoreCmd())
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via")
+	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
+	addWifiFlags(cmd)
+	cmd.Flags().String("name", "", "name for the device, if not set a name will be auto generated")
+	cmd.Flags().String("chip", "auto", "chip of the device ("+strings.Join(esploader.ChipNames(), ", ")+"), or auto to detect it")
+	cmd.Flags().String("partitions", "", "path to a custom partitions.csv (see 'jag partitions')")
+	cmd.Flags().String("batch", "", "flash the devices listed in a CSV manifest")
+	cmd.Flags().Int("jobs", 4, "number of devices to flash at the same time (works only with '--batch')")
+	cmd.Flags().Duration("identify-timeout", 2*time.Minute, "how long to wait for a flashed device to show up on the network (works only with '--batch')")
+	cmd.Flags().String("report", "", "write a report of the flashed devices to a .csv or .json file (works only with '--batch')")
+	return cmd
+}
 
-			binTmpFile, err := BuildFirmwareImage(ctx, id.String(), name, wifiSSID, wifiPassword)
-			if err != nil {
-				return err
-			}
-			defer os.Remove(binTmpFile.Name())
+// flashDevice flashes the device on the given serial port with Jaguar
+// configured with the id, name and WiFi settings. Unless quiet is set,
+// the progress is shown.
+func flashDevice(ctx context.Context, cmd *cobra.Command, port string, chipName string, baud int, id string, name string, wifi *wifiConfig, quiet bool) error {
+	if chipName != "auto" {
+		if _, err := firmwareChipByName(chipName); err != nil {
+			return err
+		}
+	}
 
-			positions := make(map[string]int)
-			sizes := make(map[string]int)
+	// Connect to the device first, so we know what chip it has
+	// before we build the image.
+	loader, err := connectLoader(port, chipName)
+	if err != nil {
+		return err
+	}
+	defer loader.Close()
+	chip := loader.Chip()
+	if err := checkFirmwareChip(chip); err != nil {
+		return fmt.Errorf("can't flash the device on port '%s': %w", port, err)
+	}
 
-			getPartitions(toitToolchainPath, positions, sizes)
+	table, custom, err := loadPartitionTable(cmd, chip)
+	if err != nil {
+		return err
+	}
 
-			// Create a file with zap bytes (0xff) for clearing the OTA data partition.
-			zappedOtaDataFile, err := createZapBytesFile(sizes, "ota")
-			if err != nil {
-				return err
-			}
-			defer os.Remove(zappedOtaDataFile.Name())
+	flashSize, err := loader.DetectFlashSize()
+	if err != nil {
+		fmt.Printf("Could not detect the flash size of the device on port '%s', so the partition table is not checked against it: %v\n", port, err)
+		flashSize = 0
+	}
+	if err := table.Validate(int(flashSize)); err != nil {
+		return err
+	}
 
-			// Create a file with zap bytes (0xff) for clearing the NVS data partition.
-			zappedNvsDataFile, err := createZapBytesFile(sizes, "nvs")
-			if err != nil {
-				return err
-			}
-			defer os.Remove(zappedNvsDataFile.Name())
-
-			flashArgs := []string{
-				"--chip", "esp32", "--port", port, "--baud", strconv.Itoa(int(baud)), "--before", "default_reset", "--after", "hard_reset", "write_flash", "-z", "--flash_mode", "dio",
-				"--flash_freq", "40m", "--flash_size", "detect",
-				hex(positions["bootloader"]), filepath.Join(esp32BinPath, "bootloader", "bootloader.bin"),
-				hex(positions["partitions"]), filepath.Join(esp32BinPath, "partitions.bin"),
-				hex(positions["ota_0"]), binTmpFile.Name(),
-			}
-			if pos, ok := positions["ota"]; ok {
-				// Force bootloader to boot from OTA 0.
-				flashArgs = append(flashArgs, hex(pos), zappedOtaDataFile.Name())
-			}
-			if pos, ok := positions["nvs"]; ok {
-				flashArgs = append(flashArgs, hex(pos), zappedNvsDataFile.Name())
-			}
+	binTmpFile, err := BuildFirmwareImage(ctx, chip.Name, id, name, wifi)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(binTmpFile.Name())
 
-			fmt.Printf("Flashing device over serial on port '%s' ...\n", port)
-			flashCmd := exec.CommandContext(ctx, esptoolPath, flashArgs...)
-			flashCmd.Stderr = os.Stderr
-			flashCmd.Stdout = os.Stdout
-			return flashCmd.Run()
-		},
+	app, err := os.ReadFile(binTmpFile.Name())
+	if err != nil {
+		return err
 	}
 
-	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via")
-	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
-	cmd.Flags().String("wifi-ssid", "", "default WiFi SSID")
-	cmd.Flags().String("wifi-password", "", "default WiFi password")
-	cmd.Flags().String("name", "", "name for the device, if not set a name will be auto generated")
-	return cmd
+	images, err := jaguarImages(chip, table, custom, app)
+	if err != nil {
+		return err
+	}
+
+	if !quiet {
+		fmt.Printf("Flashing %s device over serial on port '%s' ...\n", chip.Name, port)
+	}
+	return flashImages(loader, baud, images, quiet)
+}
+
+// connectLoader connects to the ROM bootloader of the device on the given
+// serial port. Unless the chip name is 'auto', the detected chip must
+// match it.
+func connectLoader(port string, chipName string) (*esploader.Loader, error) {
+	var expected *esploader.Chip
+	if chipName != "auto" {
+		chip, err := esploader.ChipByName(chipName)
+		if err != nil {
+			return nil, err
+		}
+		expected = chip
+	}
+
+	loader, err := esploader.Open(port)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loader.Connect(); err != nil {
+		loader.Close()
+		return nil, err
+	}
+
+	if expected != nil && loader.Chip() != expected {
+		loader.Close()
+		return nil, fmt.Errorf("the device on port '%s' is an %s, not an %s", port, loader.Chip(), expected)
+	}
+	return loader, nil
+}
+
+// flashImages writes the images to the flash of the device using the ROM
+// bootloader and reboots it. Unless quiet is set, a progress bar is shown.
+func flashImages(loader *esploader.Loader, baud int, images []esploader.Image, quiet bool) error {
+	var bar *pb.ProgressBar
+	options := esploader.FlashOptions{
+		BaudRate:  baud,
+		FlashSize: "detect",
+	}
+	if !quiet {
+		options.Progress = func(written int, total int) {
+			if bar == nil {
+				bar = pb.New(total).Start()
+			}
+			bar.SetCurrent(int64(written))
+		}
+	}
+	err := loader.WriteFlash(images, options)
+	if bar != nil {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	loader.HardReset()
+	if !quiet {
+		fmt.Println("Successfully flashed and rebooted the device")
+	}
+	return nil
 }
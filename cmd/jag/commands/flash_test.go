@@ -0,0 +1,65 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
+)
+
+func TestFirmwareChips(t *testing.T) {
+	// Pretend to use a Toit repository where the firmware has been built
+	// for some of the chips.
+	repo := t.TempDir()
+	old, wasSet := os.LookupEnv(directory.ToitRepoPathEnv)
+	os.Setenv(directory.ToitRepoPathEnv, repo)
+	defer func() {
+		if wasSet {
+			os.Setenv(directory.ToitRepoPathEnv, old)
+		} else {
+			os.Unsetenv(directory.ToitRepoPathEnv)
+		}
+	}()
+
+	install := func(chip string, files ...string) {
+		for _, f := range files {
+			p := filepath.Join(repo, f)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, p, chip)
+		}
+	}
+	install("esp32", "build/esp32/toit.bin", "build/esp32/bootloader/bootloader.bin", "toolchains/esp32/partitions.csv")
+	install("esp32s3", "build/esp32s3/toit.bin", "build/esp32s3/bootloader/bootloader.bin", "toolchains/esp32s3/partitions.csv")
+	// The C3 has no partition table.
+	install("esp32c3", "build/esp32c3/toit.bin", "build/esp32c3/bootloader/bootloader.bin")
+
+	if names := firmwareChipNames(); !reflect.DeepEqual(names, []string{"esp32", "esp32s3"}) {
+		t.Errorf("got chips %v, expected [esp32 esp32s3]", names)
+	}
+	if _, err := firmwareChipByName("ESP32-S3"); err != nil {
+		t.Error(err)
+	}
+	for _, chip := range []*esploader.Chip{esploader.ESP32S2, esploader.ESP32C3} {
+		if err := checkFirmwareChip(chip); err == nil {
+			t.Errorf("the %s has no firmware, but was accepted", chip)
+		}
+	}
+}
+
+func TestFlashAccessChips(t *testing.T) {
+	if names := flashAccessChipNames(); !reflect.DeepEqual(names, []string{"esp32"}) {
+		t.Errorf("got chips %v, expected [esp32]", names)
+	}
+	if err := checkFlashAccessChip(esploader.ESP32S3); err == nil {
+		t.Error("the ESP32-S3 was accepted for backups")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/toitware/ubjson"
+)
+
+// The config injected into an image is small, so we never look further
+// than this for the end of it.
+const imageConfigMaxSize = 16 * 1024
+
+// findImageConfig looks for the config injected into a firmware image by
+// 'jag flash', 'jag firmware build' and 'jag firmware update'. The config
+// is stored as UBJSON somewhere in the image, so we try to decode an
+// object at every possible position and return the first one that has a
+// device id or, for images built for many devices, the WiFi settings.
+func findImageConfig(data []byte) (map[string]interface{}, bool) {
+	for pos := bytes.IndexByte(data, '{'); pos >= 0; {
+		end := pos + imageConfigMaxSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if config, err := decodeImageConfig(data[pos:end]); err == nil {
+			if id, ok := config["id"].(string); ok && len(id) == 36 {
+				return config, true
+			}
+			if _, ok := config["id"]; !ok {
+				if _, ok := config["wifi"].(map[string]interface{}); ok {
+					return config, true
+				}
+			}
+		}
+		next := bytes.IndexByte(data[pos+1:], '{')
+		if next < 0 {
+			break
+		}
+		pos += next + 1
+	}
+	return nil, false
+}
+
+// activeAppPartition returns the app partition the bootloader boots, based
+// on the content of the otadata partition. If the otadata partition is
+// empty, the bootloader boots the first app partition.
+func activeAppPartition(table *PartitionTable, otadata []byte) (Partition, bool) {
+	const otaSelectSize = 32
+	var apps []Partition
+	for i := 0; i < 16; i++ {
+		if p, ok := table.Find(fmt.Sprintf("ota_%d", i)); ok {
+			apps = append(apps, p)
+		}
+	}
+	if len(apps) == 0 {
+		return Partition{}, false
+	}
+
+	// The otadata partition has two sectors, each of them starting with a
+	// sequence number. The highest valid one wins.
+	seq := uint32(0)
+	for pos := 0; pos+otaSelectSize <= len(otadata); pos += 0x1000 {
+		s := binary.LittleEndian.Uint32(otadata[pos:])
+		if s != 0xffffffff && s > seq {
+			seq = s
+		}
+	}
+	if seq == 0 {
+		return apps[0], true
+	}
+	return apps[int(seq-1)%len(apps)], true
+}
+
+// decodeImageConfig decodes the UBJSON object at the start of data. Most
+// of the positions tried by findImageConfig don't hold an object, so we
+// turn the panics caused by garbage into errors.
+func decodeImageConfig(data []byte) (config map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed config: %v", r)
+		}
+	}()
+	err = ubjson.Unmarshal(data, &config)
+	return config, err
+}
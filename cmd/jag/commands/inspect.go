@@ -0,0 +1,320 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
+	"gopkg.in/yaml.v2"
+)
+
+type firmwareInspection struct {
+	File      string              `json:"file" yaml:"file"`
+	Kind      string              `json:"kind" yaml:"kind"`
+	Chip      string              `json:"chip,omitempty" yaml:"chip,omitempty"`
+	FlashSize int                 `json:"flashSize,omitempty" yaml:"flashSize,omitempty"`
+	Device    *flashBackupDevice  `json:"device,omitempty" yaml:"device,omitempty"`
+	Images    []firmwareImageInfo `json:"images" yaml:"images"`
+}
+
+type firmwareImageInfo struct {
+	Partition      string                 `json:"partition,omitempty" yaml:"partition,omitempty"`
+	Active         bool                   `json:"active,omitempty" yaml:"active,omitempty"`
+	Offset         int                    `json:"offset" yaml:"offset"`
+	Size           int                    `json:"size" yaml:"size"`
+	SDKVersion     string                 `json:"sdkVersion,omitempty" yaml:"sdkVersion,omitempty"`
+	ProjectName    string                 `json:"projectName,omitempty" yaml:"projectName,omitempty"`
+	IDFVersion     string                 `json:"idfVersion,omitempty" yaml:"idfVersion,omitempty"`
+	BuildDate      string                 `json:"buildDate,omitempty" yaml:"buildDate,omitempty"`
+	SHA256         string                 `json:"sha256" yaml:"sha256"`
+	DigestAppended bool                   `json:"digestAppended" yaml:"digestAppended"`
+	DigestValid    bool                   `json:"digestValid" yaml:"digestValid"`
+	ELFSHA256      string                 `json:"elfSha256,omitempty" yaml:"elfSha256,omitempty"`
+	Config         map[string]interface{} `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+func FirmwareInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect <file>",
+		Short: "Show the configuration and version of a firmware image",
+		Long: "Show the Jaguar configuration, the SDK version and the hashes of a firmware\n" +
+			"image. The file can be an application image, a complete flash image built\n" +
+			"with 'jag firmware build' or a backup made with 'jag flash backup'.\n\n" +
+			"WiFi passwords are masked unless '--show-password' is given.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			showPassword, err := cmd.Flags().GetBool("show-password")
+			if err != nil {
+				return err
+			}
+
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return err
+			}
+
+			inspection, err := inspectFirmware(args[0])
+			if err != nil {
+				return err
+			}
+			if !showPassword {
+				for i := range inspection.Images {
+					if inspection.Images[i].Config == nil {
+						continue
+					}
+					inspection.Images[i].Config = maskPasswords(inspection.Images[i].Config).(map[string]interface{})
+				}
+			}
+
+			switch strings.ToLower(output) {
+			case "json":
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(inspection)
+			case "yaml":
+				return yaml.NewEncoder(os.Stdout).Encode(inspection)
+			case "short":
+				return inspection.print()
+			default:
+				return fmt.Errorf("--output flag '%s' was not recognized. Must be either json, yaml or short.", output)
+			}
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "short", "Set output format to json, yaml or short")
+	cmd.Flags().Bool("show-password", false, "show WiFi passwords instead of masking them")
+	return cmd
+}
+
+func inspectFirmware(path string) (*firmwareInspection, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &firmwareInspection{
+		File: path,
+	}
+
+	if isFlashBackup(content) {
+		backup, err := readFlashBackup(path)
+		if err != nil {
+			return nil, err
+		}
+		res.Kind = "flash backup"
+		res.Chip = backup.Header.Chip
+		res.FlashSize = backup.Header.FlashSize
+		res.Device = backup.Header.Device
+		chip, err := esploader.ChipByName(backup.Header.Chip)
+		if err != nil {
+			return nil, err
+		}
+		if images := inspectPartitions(chip, backup.find); len(images) > 0 {
+			res.Images = images
+			return res, nil
+		}
+		// Without a partition table we can still look at the regions
+		// that hold application images.
+		for i, r := range backup.Header.Regions {
+			if info, err := inspectAppImage(backup.Data[i]); err == nil {
+				info.Partition = r.Name
+				info.Offset = r.Offset
+				res.Images = append(res.Images, *info)
+			}
+		}
+		if len(res.Images) == 0 {
+			return nil, fmt.Errorf("found no firmware in the backup '%s'", path)
+		}
+		return res, nil
+	}
+
+	if len(content) >= partitionTableOffset+2 && binary.LittleEndian.Uint16(content[partitionTableOffset:]) == 0xaa50 {
+		res.Kind = "flash image"
+		find := func(offset int, size int) ([]byte, bool) {
+			if offset+size > len(content) {
+				if offset >= len(content) {
+					return nil, false
+				}
+				// The image ends after the last written data.
+				return content[offset:], true
+			}
+			return content[offset : offset+size], true
+		}
+		// The chip only matters for the offset of the bootloader, which
+		// we don't look at.
+		res.Images = inspectPartitions(esploader.ESP32, find)
+		if len(res.Images) == 0 {
+			return nil, fmt.Errorf("found no firmware in the flash image '%s'", path)
+		}
+		return res, nil
+	}
+
+	info, err := inspectAppImage(content)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a firmware image, flash image or flash backup: %w", path, err)
+	}
+	res.Kind = "application image"
+	res.Images = []firmwareImageInfo{*info}
+	return res, nil
+}
+
+// inspectPartitions inspects the application images in the app partitions
+// of a flash image. The find function returns the content of the flash
+// at the given offset, if it is available.
+func inspectPartitions(chip *esploader.Chip, find func(offset int, size int) ([]byte, bool)) []firmwareImageInfo {
+	tableData, ok := find(partitionTableOffset, partitionTableSize)
+	if !ok {
+		return nil
+	}
+	table, err := ParsePartitionsBinary(tableData, "the partition table", chip)
+	if err != nil {
+		return nil
+	}
+
+	var otadata []byte
+	if p, ok := table.Find("ota"); ok {
+		otadata, _ = find(p.Offset, p.Size)
+	}
+	active, _ := activeAppPartition(table, otadata)
+
+	var res []firmwareImageInfo
+	for _, p := range table.Partitions {
+		if p.Type != "app" {
+			continue
+		}
+		data, ok := find(p.Offset, p.Size)
+		if !ok {
+			continue
+		}
+		info, err := inspectAppImage(data)
+		if err != nil {
+			// Erased or not part of the image.
+			continue
+		}
+		info.Partition = p.Name
+		info.Offset = p.Offset
+		info.Active = p.Name == active.Name
+		res = append(res, *info)
+	}
+	return res
+}
+
+func inspectAppImage(data []byte) (*firmwareImageInfo, error) {
+	image, err := esploader.ParseAppImage(data)
+	if err != nil {
+		return nil, err
+	}
+	res := &firmwareImageInfo{
+		Size:           image.Length,
+		SDKVersion:     image.Version,
+		ProjectName:    image.ProjectName,
+		IDFVersion:     image.IDFVersion,
+		SHA256:         image.SHA256,
+		DigestAppended: image.DigestAppended,
+		DigestValid:    image.DigestValid,
+		ELFSHA256:      image.ELFSHA256,
+	}
+	if image.BuildDate != "" {
+		res.BuildDate = strings.TrimSpace(image.BuildDate + " " + image.BuildTime)
+	}
+	if config, ok := findImageConfig(data[:image.Length]); ok {
+		res.Config = config
+	}
+	return res, nil
+}
+
+// maskPasswords returns a copy of the config where all values with a key
+// that mentions a password are masked.
+func maskPasswords(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := map[string]interface{}{}
+		for key, entry := range v {
+			if s, ok := entry.(string); ok && strings.Contains(strings.ToLower(key), "password") && s != "" {
+				res[key] = "********"
+			} else {
+				res[key] = maskPasswords(entry)
+			}
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, entry := range v {
+			res[i] = maskPasswords(entry)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+func (i *firmwareInspection) print() error {
+	fmt.Printf("File:         %s (%s)\n", i.File, i.Kind)
+	if i.Chip != "" {
+		fmt.Printf("Chip:         %s\n", i.Chip)
+	}
+	if i.FlashSize != 0 {
+		fmt.Printf("Flash size:   %dMB\n", i.FlashSize>>20)
+	}
+	if i.Device != nil {
+		fmt.Printf("Device:       %s (%s)\n", i.Device.Name, i.Device.ID)
+	}
+
+	for _, image := range i.Images {
+		fmt.Println()
+		if image.Partition != "" {
+			active := ""
+			if image.Active {
+				active = ", active"
+			}
+			fmt.Printf("Firmware in %s (0x%x%s):\n", image.Partition, image.Offset, active)
+		} else {
+			fmt.Println("Firmware:")
+		}
+		if image.SDKVersion != "" {
+			fmt.Printf("  SDK version:  %s\n", image.SDKVersion)
+		}
+		if image.ProjectName != "" {
+			fmt.Printf("  Project:      %s\n", image.ProjectName)
+		}
+		if image.IDFVersion != "" {
+			fmt.Printf("  IDF version:  %s\n", image.IDFVersion)
+		}
+		if image.BuildDate != "" {
+			fmt.Printf("  Built:        %s\n", image.BuildDate)
+		}
+		fmt.Printf("  Size:         %d bytes\n", image.Size)
+		digest := "no digest appended"
+		if image.DigestAppended && image.DigestValid {
+			digest = "matches appended digest"
+		} else if image.DigestAppended {
+			digest = "DOES NOT MATCH appended digest"
+		}
+		fmt.Printf("  SHA256:       %s (%s)\n", image.SHA256, digest)
+		if image.ELFSHA256 != "" {
+			fmt.Printf("  ELF SHA256:   %s\n", image.ELFSHA256)
+		}
+		if image.Config == nil {
+			fmt.Println("  Config:       none found")
+			continue
+		}
+		config, err := yaml.Marshal(image.Config)
+		if err != nil {
+			return err
+		}
+		fmt.Println("  Config:")
+		for _, line := range strings.Split(strings.TrimRight(string(config), "\n"), "\n") {
+			fmt.Println("    " + line)
+		}
+	}
+	return nil
+}
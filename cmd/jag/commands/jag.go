@@ -107,11 +107,15 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 		RunCmd(),
 		CompileCmd(),
 		SimulateCmd(),
+		NetemCmd(),
 		DecodeCmd(),
 		SetupCmd(info),
 		FlashCmd(),
+		PartitionsCmd(),
 		FirmwareCmd(),
+		DeviceCmd(),
 		MonitorCmd(),
+		LogsCmd(),
 		WatchCmd(),
 		PortCmd(),
 		ToitCmd(),
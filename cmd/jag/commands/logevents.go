@@ -0,0 +1,410 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// LogEvent is a structured version of a line of console output. The Toit
+// logging library prints log messages in the format:
+//
+//	[name] LEVEL: message {key: value, ...}
+//
+// where the name and the tags are optional. Lines that are not in this
+// format (like the output of 'print') become events with just a message.
+//
+// The time of an event is when the device printed the line, if the device
+// tells us (like 'jag logs' does). For the output read from a serial port
+// or a simulator, it is when jag received the line.
+type LogEvent struct {
+	Time    time.Time         `json:"time"`
+	Device  string            `json:"device,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Level   string            `json:"level,omitempty"`
+	Message string            `json:"message"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+var logLineRegexp = regexp.MustCompile(`^(?:\[([^\]]*)\] )?(DEBUG|INFO|WARN|ERROR|FATAL): (.*)$`)
+
+// ParseLogLine parses a line of console output into a log event.
+func ParseLogLine(line string) LogEvent {
+	match := logLineRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return LogEvent{Message: line}
+	}
+
+	res := LogEvent{
+		Name:    match[1],
+		Level:   match[2],
+		Message: match[3],
+	}
+	if open := strings.LastIndex(res.Message, " {"); open >= 0 && strings.HasSuffix(res.Message, "}") {
+		if tags, ok := parseLogTags(res.Message[open+2 : len(res.Message)-1]); ok {
+			res.Message = res.Message[:open]
+			res.Tags = tags
+		}
+	}
+	return res
+}
+
+// splitLogAge splits a line streamed by a device that sends the ages of
+// the lines into the time the line was printed and the line itself.
+func splitLogAge(line string, received time.Time) (time.Time, string) {
+	space := strings.IndexByte(line, ' ')
+	if space < 0 {
+		return received, line
+	}
+	age, err := strconv.ParseInt(line[:space], 10, 64)
+	if err != nil || age < 0 {
+		return received, line
+	}
+	return received.Add(-time.Duration(age) * time.Microsecond), line[space+1:]
+}
+
+func parseLogTags(s string) (map[string]string, bool) {
+	res := map[string]string{}
+	for _, pair := range strings.Split(s, ", ") {
+		colon := strings.Index(pair, ": ")
+		if colon <= 0 {
+			return nil, false
+		}
+		res[pair[:colon]] = pair[colon+2:]
+	}
+	return res, true
+}
+
+// severityNumber maps the Toit log levels to the OpenTelemetry severity
+// numbers.
+func (e LogEvent) severityNumber() int {
+	switch e.Level {
+	case "DEBUG":
+		return 5
+	case "INFO":
+		return 9
+	case "WARN":
+		return 13
+	case "ERROR":
+		return 17
+	case "FATAL":
+		return 21
+	default:
+		return 0
+	}
+}
+
+type logEventSink interface {
+	Emit(event LogEvent) error
+	Close() error
+}
+
+// logOutput describes what to do with the console output of a device as
+// selected through the flags added by addLogOutputFlags.
+type logOutput struct {
+	// If set, the console output is printed as JSON lines instead of text.
+	json bool
+	// Where to send log events. May be nil.
+	events logEventSink
+}
+
+func addLogOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().String("format", "text", "print the console output as text or as json lines with one log event per line")
+	cmd.Flags().String("otlp-endpoint", "", "forward log events to an OTLP/HTTP collector (e.g. http://localhost:4318)")
+}
+
+func parseLogOutputFlags(cmd *cobra.Command) (*logOutput, error) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := cmd.Flags().GetString("otlp-endpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &logOutput{}
+	var sinks multiLogSink
+	switch strings.ToLower(format) {
+	case "text":
+	case "json":
+		res.json = true
+		sinks = append(sinks, newJSONLogSink(os.Stdout))
+	default:
+		return nil, fmt.Errorf("--format flag '%s' was not recognized. Must be either text or json.", format)
+	}
+
+	if endpoint != "" {
+		sinks = append(sinks, newOTLPLogSink(endpoint))
+	}
+
+	if len(sinks) == 1 {
+		res.events = sinks[0]
+	} else if len(sinks) > 1 {
+		res.events = sinks
+	}
+	return res, nil
+}
+
+func (o *logOutput) newDecoder(scanner *bufio.Scanner, cmd *cobra.Command, device string, prefix string) *Decoder {
+	return &Decoder{
+		scanner: scanner,
+		cmd:     cmd,
+		prefix:  prefix,
+		device:  device,
+		events:  o.events,
+		quiet:   o.json,
+	}
+}
+
+func (o *logOutput) Close() error {
+	if o.events == nil {
+		return nil
+	}
+	return o.events.Close()
+}
+
+type multiLogSink []logEventSink
+
+func (m multiLogSink) Emit(event LogEvent) error {
+	for _, s := range m {
+		if err := s.Emit(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiLogSink) Close() error {
+	var res error
+	for _, s := range m {
+		if err := s.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// jsonLogSink writes log events as JSON lines.
+type jsonLogSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONLogSink(w io.Writer) *jsonLogSink {
+	return &jsonLogSink{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (s *jsonLogSink) Emit(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(event)
+}
+
+func (s *jsonLogSink) Close() error {
+	return nil
+}
+
+const (
+	otlpBatchSize     = 100
+	otlpFlushInterval = time.Second
+)
+
+// otlpLogSink forwards log events to an OpenTelemetry collector using
+// the OTLP/HTTP protocol with JSON encoding. Events are sent in batches
+// from a background goroutine.
+type otlpLogSink struct {
+	sync.Mutex
+	url     string
+	pending []LogEvent
+	closed  bool
+	failed  bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newOTLPLogSink(endpoint string) *otlpLogSink {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/logs") {
+		url += "/v1/logs"
+	}
+	res := &otlpLogSink{
+		url:     url,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go res.run()
+	return res
+}
+
+func (s *otlpLogSink) Emit(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.pending = append(s.pending, event)
+	return nil
+}
+
+func (s *otlpLogSink) Close() error {
+	s.Lock()
+	s.closed = true
+	s.Unlock()
+	close(s.done)
+	<-s.stopped
+	return s.flush()
+}
+
+func (s *otlpLogSink) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				s.reportFailure(err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *otlpLogSink) reportFailure(err error) {
+	// Only report the first failure to avoid flooding the output when
+	// the collector isn't running.
+	if !s.failed {
+		fmt.Fprintf(os.Stderr, "Failed to forward log events to '%s': %v\n", s.url, err)
+		s.failed = true
+	}
+}
+
+func (s *otlpLogSink) flush() error {
+	for {
+		s.Lock()
+		batch := s.pending
+		if len(batch) > otlpBatchSize {
+			batch = batch[:otlpBatchSize]
+		}
+		s.pending = s.pending[len(batch):]
+		s.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.send(batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *otlpLogSink) send(events []LogEvent) error {
+	body, err := json.Marshal(otlpLogsRequest(events))
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("got non-OK from collector: %s", res.Status)
+	}
+	return nil
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber,omitempty"`
+	SeverityText   string         `json:"severityText,omitempty"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// otlpLogsRequest builds the body of an OTLP/HTTP export request. The
+// events are grouped by device, so each device becomes a resource.
+func otlpLogsRequest(events []LogEvent) map[string]interface{} {
+	var resources []*otlpResourceLogs
+	byDevice := map[string]*otlpResourceLogs{}
+	for _, e := range events {
+		r, ok := byDevice[e.Device]
+		if !ok {
+			r = &otlpResourceLogs{}
+			r.Resource.Attributes = []otlpKeyValue{otlpString("service.name", "jaguar")}
+			if e.Device != "" {
+				r.Resource.Attributes = append(r.Resource.Attributes, otlpString("device.name", e.Device))
+			}
+			r.ScopeLogs = []otlpScopeLogs{{}}
+			r.ScopeLogs[0].Scope.Name = "jag"
+			byDevice[e.Device] = r
+			resources = append(resources, r)
+		}
+
+		record := otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(e.Time.UnixNano(), 10),
+			SeverityNumber: e.severityNumber(),
+			SeverityText:   e.Level,
+			Body:           otlpAnyValue{StringValue: e.Message},
+		}
+		if e.Name != "" {
+			record.Attributes = append(record.Attributes, otlpString("logger.name", e.Name))
+		}
+		for k, v := range e.Tags {
+			record.Attributes = append(record.Attributes, otlpString(k, v))
+		}
+		r.ScopeLogs[0].LogRecords = append(r.ScopeLogs[0].LogRecords, record)
+	}
+	return map[string]interface{}{
+		"resourceLogs": resources,
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want LogEvent
+	}{
+		{"hello", LogEvent{Message: "hello"}},
+		{"", LogEvent{Message: ""}},
+		{"INFO: started", LogEvent{Level: "INFO", Message: "started"}},
+		{"[wifi] WARN: weak signal", LogEvent{Name: "wifi", Level: "WARN", Message: "weak signal"}},
+		{"[] DEBUG: no name", LogEvent{Level: "DEBUG", Message: "no name"}},
+		{"NOTICE: unknown level", LogEvent{Message: "NOTICE: unknown level"}},
+		{
+			"[http] ERROR: request failed {status: 500, path: /logs}",
+			LogEvent{Name: "http", Level: "ERROR", Message: "request failed", Tags: map[string]string{"status": "500", "path": "/logs"}},
+		},
+		{
+			"INFO: got {a: 1} {b: 2}",
+			LogEvent{Level: "INFO", Message: "got {a: 1}", Tags: map[string]string{"b": "2"}},
+		},
+		// Braces that don't hold tags are part of the message.
+		{"INFO: list is {1, 2, 3}", LogEvent{Level: "INFO", Message: "list is {1, 2, 3}"}},
+		{"INFO: empty {}", LogEvent{Level: "INFO", Message: "empty {}"}},
+		{"INFO: {a: 1} first", LogEvent{Level: "INFO", Message: "{a: 1} first"}},
+		{"INFO: no space{a: 1}", LogEvent{Level: "INFO", Message: "no space{a: 1}"}},
+		{"print {a: 1}", LogEvent{Message: "print {a: 1}"}},
+	}
+	for _, test := range tests {
+		got := ParseLogLine(test.line)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseLogLine(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseLogTags(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]string
+		ok   bool
+	}{
+		{"a: 1", map[string]string{"a": "1"}, true},
+		{"a: 1, b: two words", map[string]string{"a": "1", "b": "two words"}, true},
+		{"a: x: y", map[string]string{"a": "x: y"}, true},
+		{"a: {b: 1}", map[string]string{"a": "{b: 1}"}, true},
+		{"a: ", map[string]string{"a": ""}, true},
+		{"", nil, false},
+		{"1, 2", nil, false},
+		{": 1", nil, false},
+		{"a: 1, b", nil, false},
+		{"a:1", nil, false},
+	}
+	for _, test := range tests {
+		got, ok := parseLogTags(test.s)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseLogTags(%q) = %v, %v, want %v, %v", test.s, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestSplitLogAge(t *testing.T) {
+	received := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line     string
+		wantTime time.Time
+		wantLine string
+	}{
+		{"0 hello", received, "hello"},
+		{"1500000 INFO: started", received.Add(-1500 * time.Millisecond), "INFO: started"},
+		{"42 ", received.Add(-42 * time.Microsecond), ""},
+		{"hello world", received, "hello world"},
+		{"-5 negative", received, "-5 negative"},
+		{"12", received, "12"},
+		{"", received, ""},
+	}
+	for _, test := range tests {
+		gotTime, gotLine := splitLogAge(test.line, received)
+		if !gotTime.Equal(test.wantTime) || gotLine != test.wantLine {
+			t.Errorf("splitLogAge(%q) = %v, %q, want %v, %q", test.line, gotTime, gotLine, test.wantTime, test.wantLine)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+func LogsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show the console output of Jaguar devices via WiFi",
+		Long: "Show the console output of Jaguar devices via WiFi. Unlike 'jag monitor'\n" +
+			"this does not need a serial connection to the device. Stack traces are\n" +
+			"decoded just like they are by 'jag monitor'.\n\n" +
+			"The device only buffers the most recent output, so use '--follow' to keep\n" +
+			"receiving output as it is printed. Use '-d' more than once to show the\n" +
+			"output of several devices at once.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			deviceSelects, err := parseDevicesFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			follow, err := cmd.Flags().GetBool("follow")
+			if err != nil {
+				return err
+			}
+
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			output, err := parseLogOutputFlags(cmd)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+
+			devices, err := GetDevices(ctx, cfg, sdk, true, deviceSelects)
+			if err != nil {
+				return err
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(devices))
+			for i, device := range devices {
+				prefix := ""
+				if len(devices) > 1 {
+					prefix = "[" + device.Name + "] "
+				}
+				wg.Add(1)
+				go func(i int, device *Device, prefix string) {
+					defer wg.Done()
+					stream, err := device.Logs(ctx, sdk, follow)
+					if err != nil {
+						errs[i] = fmt.Errorf("failed to get logs from '%s': %w", device.Name, err)
+						return
+					}
+					defer stream.Close()
+
+					scanner := bufio.NewScanner(stream)
+					decoder := output.newDecoder(scanner, cmd, device.Name, prefix)
+					decoder.withAge = stream.withAge
+					decoder.decode()
+					errs[i] = scanner.Err()
+				}(i, device, prefix)
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayP("device", "d", nil, "use device with a given name, id, or address (can be repeated)")
+	cmd.Flags().BoolP("follow", "f", false, "keep streaming the output as it is printed")
+	addLogOutputFlags(cmd)
+	return cmd
+}
@@ -42,7 +42,15 @@ func MonitorCmd() *cobra.Command {
 				return err
 			}
 
-			fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
+			output, err := parseLogOutputFlags(cmd)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+
+			if !output.json {
+				fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
+			}
 			dev, err := serialOpen(port, &serial.Mode{
 				BaudRate: int(baud),
 			})
@@ -56,7 +64,7 @@ func MonitorCmd() *cobra.Command {
 
 			scanner := bufio.NewScanner(dev)
 
-			decoder := Decoder{scanner, cmd}
+			decoder := output.newDecoder(scanner, cmd, port, "")
 
 			decoder.decode()
 
@@ -67,6 +75,7 @@ func MonitorCmd() *cobra.Command {
 	cmd.Flags().StringP("port", "p", ConfiguredPort(), "port to monitor")
 	cmd.Flags().BoolP("attach", "a", false, "attach to the serial output without rebooting it")
 	cmd.Flags().Uint("baud", 115200, "the baud rate for serial monitoring")
+	addLogOutputFlags(cmd)
 	return cmd
 }
 
@@ -0,0 +1,567 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// netemConfig describes how the network between jag and a device is
+// impaired.
+type netemConfig struct {
+	// The one-way delay added to all data.
+	Latency time.Duration
+	// The fraction of packets that are lost. TCP retransmits lost packets,
+	// so a lost packet arrives late instead of not at all.
+	Loss float64
+	// The bandwidth in bytes per second. Zero means unlimited.
+	Bandwidth int
+	// Connections are cut after this many bytes. Zero means never.
+	CutAfter int64
+	// The seed for deciding which packets are lost, so runs can be
+	// repeated.
+	Seed int64
+}
+
+const (
+	// The size of the packets the data is split into.
+	netemPacketSize = 1024
+	// The minimum time before TCP retransmits a lost packet.
+	netemMinRetransmitTimeout = 200 * time.Millisecond
+)
+
+func (c netemConfig) enabled() bool {
+	return c.Latency > 0 || c.Loss > 0 || c.Bandwidth > 0 || c.CutAfter > 0
+}
+
+func (c netemConfig) String() string {
+	var parts []string
+	if c.Latency > 0 {
+		parts = append(parts, fmt.Sprintf("%s latency", c.Latency))
+	}
+	if c.Loss > 0 {
+		parts = append(parts, fmt.Sprintf("%g%% loss", c.Loss*100))
+	}
+	if c.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("%dbps", c.Bandwidth*8))
+	}
+	if c.CutAfter > 0 {
+		parts = append(parts, fmt.Sprintf("cut after %d bytes", c.CutAfter))
+	}
+	if len(parts) == 0 {
+		return "no impairments"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func addNetemFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("latency", 0, "delay all data by this much in each direction (e.g. 200ms)")
+	cmd.Flags().String("loss", "", "percentage of packets that are lost and must be retransmitted (e.g. 5%)")
+	cmd.Flags().String("bandwidth", "", "limit the bandwidth in each direction (e.g. 20kbps)")
+	cmd.Flags().String("cut-after", "", "cut connections after this many bytes (e.g. 64K) to simulate dropped connections")
+	cmd.Flags().Int64("seed", 1, "seed for picking the lost packets, so runs can be repeated")
+}
+
+func parseNetemFlags(cmd *cobra.Command) (netemConfig, error) {
+	var res netemConfig
+	var err error
+	if res.Latency, err = cmd.Flags().GetDuration("latency"); err != nil {
+		return res, err
+	}
+	if res.Latency < 0 {
+		return res, fmt.Errorf("--latency cannot be negative")
+	}
+
+	loss, err := cmd.Flags().GetString("loss")
+	if err != nil {
+		return res, err
+	}
+	if loss != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(loss, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return res, fmt.Errorf("invalid --loss '%s', it must be a percentage like 5%%", loss)
+		}
+		res.Loss = percent / 100
+	}
+
+	bandwidth, err := cmd.Flags().GetString("bandwidth")
+	if err != nil {
+		return res, err
+	}
+	if bandwidth != "" {
+		if res.Bandwidth, err = parseBandwidth(bandwidth); err != nil {
+			return res, err
+		}
+	}
+
+	cutAfter, err := cmd.Flags().GetString("cut-after")
+	if err != nil {
+		return res, err
+	}
+	if cutAfter != "" {
+		size, err := parsePartitionSize(cutAfter)
+		if err != nil || size <= 0 {
+			return res, fmt.Errorf("invalid --cut-after '%s', it must be a number of bytes like 65536 or 64K", cutAfter)
+		}
+		res.CutAfter = int64(size)
+	}
+
+	if res.Seed, err = cmd.Flags().GetInt64("seed"); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// parseBandwidth parses a bandwidth in bits per second, like 20kbps or
+// 1mbps, and returns it in bytes per second.
+func parseBandwidth(s string) (int, error) {
+	value := strings.TrimSuffix(strings.ToLower(s), "bps")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1000 * 1000
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	bits, err := strconv.ParseFloat(value, 64)
+	if err != nil || bits*multiplier < 8 {
+		return 0, fmt.Errorf("invalid --bandwidth '%s', it must be in bits per second like 20kbps", s)
+	}
+	return int(bits * multiplier / 8), nil
+}
+
+// netem impairs connections. Every direction of every connection has its
+// own source of random numbers, derived from the seed and the number of
+// the connection, so the lost packets don't depend on how the
+// connections are interleaved.
+type netem struct {
+	config netemConfig
+
+	mutex       sync.Mutex
+	connections int64
+}
+
+func newNetem(config netemConfig) *netem {
+	return &netem{
+		config: config,
+	}
+}
+
+// nextConnection returns the number of the next connection.
+func (n *netem) nextConnection() int64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	res := n.connections
+	n.connections++
+	return res
+}
+
+// lineRand returns the source of random numbers for the given direction
+// (0 or 1) of the given connection.
+func (n *netem) lineRand(connection int64, direction int64) *rand.Rand {
+	// Spread the numbers of the lines, so nearby seeds don't give
+	// overlapping sequences.
+	line := uint64(2*connection+direction+1) * 0x9e3779b97f4a7c15
+	return rand.New(rand.NewSource(int64(uint64(n.config.Seed) ^ line)))
+}
+
+// retransmitTimeout returns the extra delay of a lost packet, which is
+// the time it takes TCP to notice that it was lost and to retransmit it.
+func (c netemConfig) retransmitTimeout() time.Duration {
+	timeout := 2 * c.Latency
+	if timeout < netemMinRetransmitTimeout {
+		timeout = netemMinRetransmitTimeout
+	}
+	return timeout
+}
+
+type netemListener struct {
+	net.Listener
+	netem *netem
+}
+
+func (l *netemListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newImpairedConn(conn, l.netem), nil
+}
+
+type netemPacket struct {
+	data []byte
+	lost bool
+	due  time.Time
+	err  error
+}
+
+// delayLine delivers packets after the latency, the time it takes to
+// send them with the bandwidth and the penalty for lost packets. The
+// data is split into packets at fixed offsets, so the lost packets only
+// depend on the random numbers and the position of the data in the
+// stream, not on how the data is read and written.
+type delayLine struct {
+	config   netemConfig
+	rand     *rand.Rand
+	packets  chan netemPacket
+	nextFree time.Time // When the link is done sending the previous packet.
+	offset   int64     // The number of bytes sent through the line.
+	lost     bool      // Whether the packet at the offset is lost.
+}
+
+func newDelayLine(config netemConfig, rand *rand.Rand) *delayLine {
+	return &delayLine{
+		config:  config,
+		rand:    rand,
+		packets: make(chan netemPacket, 64),
+	}
+}
+
+func (l *delayLine) schedule(size int, lost bool) time.Time {
+	now := time.Now()
+	start := l.nextFree
+	if start.Before(now) {
+		start = now
+	}
+	if bandwidth := l.config.Bandwidth; bandwidth > 0 {
+		start = start.Add(time.Duration(size) * time.Second / time.Duration(bandwidth))
+	}
+	l.nextFree = start
+	due := start.Add(l.config.Latency)
+	if lost {
+		due = due.Add(l.config.retransmitTimeout())
+	}
+	return due
+}
+
+// send splits the data at the packet boundaries and queues the parts.
+// The data must not be changed afterwards.
+func (l *delayLine) send(data []byte) {
+	for len(data) > 0 {
+		inPacket := int(l.offset % netemPacketSize)
+		if inPacket == 0 {
+			l.lost = l.config.Loss > 0 && l.rand.Float64() < l.config.Loss
+		}
+		size := netemPacketSize - inPacket
+		if size > len(data) {
+			size = len(data)
+		}
+		l.packets <- netemPacket{data: data[:size], lost: l.lost, due: l.schedule(size, l.lost)}
+		l.offset += int64(size)
+		data = data[size:]
+	}
+}
+
+func (l *delayLine) sendError(err error) {
+	l.packets <- netemPacket{err: err, due: l.schedule(0, false)}
+}
+
+// impairedConn is a connection where all data goes through delay lines.
+type impairedConn struct {
+	net.Conn
+	netem *netem
+
+	in      *delayLine
+	pending []byte
+	readErr error
+
+	out       *delayLine
+	outMutex  sync.Mutex
+	outClosed bool
+	outDone   chan struct{}
+
+	// The sender sets the error without taking the outMutex, because a
+	// writer can hold it while waiting for the sender.
+	writeErrMutex sync.Mutex
+	writeErr      error
+
+	countMutex  sync.Mutex
+	transferred int64
+	closeOnce   sync.Once
+}
+
+func newImpairedConn(conn net.Conn, n *netem) *impairedConn {
+	connection := n.nextConnection()
+	c := &impairedConn{
+		Conn:    conn,
+		netem:   n,
+		in:      newDelayLine(n.config, n.lineRand(connection, 0)),
+		out:     newDelayLine(n.config, n.lineRand(connection, 1)),
+		outDone: make(chan struct{}),
+	}
+	go c.receive()
+	go c.send()
+	return c
+}
+
+// count adds to the bytes transferred and returns how many of the size
+// bytes may still be transferred before the connection is cut.
+func (c *impairedConn) count(size int) int {
+	if c.netem.config.CutAfter == 0 {
+		return size
+	}
+	c.countMutex.Lock()
+	defer c.countMutex.Unlock()
+	left := c.netem.config.CutAfter - c.transferred
+	if left < int64(size) {
+		size = int(left)
+	}
+	c.transferred += int64(size)
+	return size
+}
+
+func (c *impairedConn) cut() {
+	c.Conn.Close()
+}
+
+func (c *impairedConn) receive() {
+	defer close(c.in.packets)
+	for {
+		buf := make([]byte, netemPacketSize)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			allowed := c.count(n)
+			c.in.send(buf[:allowed])
+			if allowed < n {
+				c.cut()
+				c.in.sendError(io.ErrUnexpectedEOF)
+				return
+			}
+		}
+		if err != nil {
+			c.in.sendError(err)
+			return
+		}
+	}
+}
+
+func (c *impairedConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		packet, ok := <-c.in.packets
+		if !ok {
+			return 0, io.EOF
+		}
+		time.Sleep(time.Until(packet.due))
+		c.pending = packet.data
+		c.readErr = packet.err
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *impairedConn) send() {
+	defer close(c.outDone)
+	for packet := range c.out.packets {
+		time.Sleep(time.Until(packet.due))
+		if _, err := c.Conn.Write(packet.data); err != nil {
+			c.writeErrMutex.Lock()
+			c.writeErr = err
+			c.writeErrMutex.Unlock()
+			// Drain the remaining packets, so writers don't block.
+			for range c.out.packets {
+			}
+			return
+		}
+	}
+}
+
+func (c *impairedConn) Write(p []byte) (int, error) {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if c.outClosed {
+		return 0, net.ErrClosed
+	}
+	c.writeErrMutex.Lock()
+	writeErr := c.writeErr
+	c.writeErrMutex.Unlock()
+	if writeErr != nil {
+		return 0, writeErr
+	}
+	allowed := c.count(len(p))
+	c.out.send(append([]byte(nil), p[:allowed]...))
+	if allowed < len(p) {
+		c.closeOut()
+		go func() {
+			<-c.outDone
+			c.cut()
+		}()
+		return allowed, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func (c *impairedConn) closeOut() {
+	if !c.outClosed {
+		c.outClosed = true
+		close(c.out.packets)
+	}
+}
+
+// Close delivers the data that has been written before closing the
+// connection.
+func (c *impairedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.outMutex.Lock()
+		c.closeOut()
+		c.outMutex.Unlock()
+		<-c.outDone
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// newNetemProxy returns a server that forwards HTTP requests to the device
+// at target over an impaired network. The address the device announces
+// in its identity is replaced by the address of the proxy, so jag keeps
+// talking to the proxy.
+func newNetemProxy(target string) (*http.Server, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	// Stream the responses, so 'jag logs --follow' works.
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if res.Request.URL.Path != "/identify" || res.StatusCode != http.StatusOK {
+			return nil
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(body, &msg); err == nil {
+			if payload, ok := msg["payload"].(map[string]interface{}); ok {
+				if host := res.Request.Header.Get(netemHostHeader); host != "" {
+					payload["address"] = "http://" + host
+				}
+				if rewritten, err := json.Marshal(msg); err == nil {
+					body = rewritten
+				}
+			}
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		// Remember the address the client used for the proxy, before the
+		// request is changed to go to the device.
+		req.Header.Set(netemHostHeader, req.Host)
+		director(req)
+	}
+	return &http.Server{Handler: proxy}, nil
+}
+
+// The proxy passes the address the client used on to itself in this
+// header.
+const netemHostHeader = "X-Jaguar-Netem-Host"
+
+// serveNetemProxy serves the proxy until the context is done.
+func serveNetemProxy(ctx context.Context, listener net.Listener, target string, config netemConfig) error {
+	server, err := newNetemProxy(target)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err = server.Serve(&netemListener{Listener: listener, netem: newNetem(config)})
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func NetemCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "netem",
+		Short: "Forward to a device over a simulated bad network",
+		Long: "Start a proxy that forwards to a device over a simulated bad network with\n" +
+			"latency, lost packets, limited bandwidth and dropped connections. Use the\n" +
+			"address of the proxy with '-d' to reach the device through it, for example\n" +
+			"'jag run -d 127.0.0.1:9100 hello.toit'.\n\n" +
+			"Lost packets are picked with a seeded random generator. Every connection\n" +
+			"gets its own generator and the data is split into packets at fixed\n" +
+			"offsets, so the same commands see the same lost packets every time.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := parseNetemFlags(cmd)
+			if err != nil {
+				return err
+			}
+
+			port, err := cmd.Flags().GetUint("port")
+			if err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				return err
+			}
+			proxyPort := listener.Addr().(*net.TCPAddr).Port
+			fmt.Printf("Forwarding port %d to '%s' (%s) with %s\n", proxyPort, device.Name, device.Address, config)
+			fmt.Printf("Use '-d 127.0.0.1:%d' to talk to the device through the proxy\n", proxyPort)
+			return serveNetemProxy(ctx, listener, device.Address, config)
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().UintP("port", "p", 9100, "port to listen on")
+	addNetemFlags(cmd)
+	return cmd
+}
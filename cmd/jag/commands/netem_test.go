@@ -0,0 +1,201 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// lostBytes sends the data through a delay line in chunks of the given
+// size and returns for every byte whether it was in a lost packet.
+func lostBytes(n *netem, data []byte, chunkSize int) []bool {
+	line := newDelayLine(n.config, n.lineRand(0, 0))
+	done := make(chan []bool)
+	go func() {
+		var res []bool
+		for packet := range line.packets {
+			for range packet.data {
+				res = append(res, packet.lost)
+			}
+		}
+		done <- res
+	}()
+	for pos := 0; pos < len(data); pos += chunkSize {
+		end := pos + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		line.send(data[pos:end])
+	}
+	close(line.packets)
+	return <-done
+}
+
+func TestNetemLossIndependentOfChunks(t *testing.T) {
+	n := newNetem(netemConfig{Loss: 0.3, Seed: 7})
+	data := make([]byte, 20*netemPacketSize+100)
+	expected := lostBytes(n, data, len(data))
+	lost := 0
+	for i, l := range expected {
+		if i%netemPacketSize != 0 && l != expected[i-1] {
+			t.Fatalf("loss changes within the packet at byte %d", i)
+		}
+		if l {
+			lost++
+		}
+	}
+	if lost == 0 || lost == len(expected) {
+		t.Fatalf("expected some but not all packets to be lost, got %d of %d bytes", lost, len(expected))
+	}
+
+	for _, chunkSize := range []int{1, 7, 1000, netemPacketSize, 3000} {
+		actual := lostBytes(n, data, chunkSize)
+		if len(actual) != len(expected) {
+			t.Fatalf("chunks of %d: got %d bytes, expected %d", chunkSize, len(actual), len(expected))
+		}
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Fatalf("chunks of %d: loss of byte %d differs", chunkSize, i)
+			}
+		}
+	}
+}
+
+func TestNetemLineRand(t *testing.T) {
+	n := newNetem(netemConfig{Seed: 1})
+	first := func(connection int64, direction int64) int64 {
+		return n.lineRand(connection, direction).Int63()
+	}
+	if first(3, 1) != first(3, 1) {
+		t.Error("the same line gives different numbers")
+	}
+	seen := map[int64]string{}
+	for connection := int64(0); connection < 4; connection++ {
+		for direction := int64(0); direction < 2; direction++ {
+			line := fmt.Sprintf("%d/%d", connection, direction)
+			value := first(connection, direction)
+			if other, ok := seen[value]; ok {
+				t.Errorf("lines %s and %s give the same numbers", other, line)
+			}
+			seen[value] = line
+		}
+	}
+	if newNetem(netemConfig{Seed: 2}).lineRand(0, 0).Int63() == first(0, 0) {
+		t.Error("the seed doesn't change the numbers")
+	}
+	if n.nextConnection() != 0 || n.nextConnection() != 1 {
+		t.Error("connections are not numbered in order")
+	}
+}
+
+// startNetemProxy starts a device stand-in and a proxy in front of it
+// and returns the address of the proxy.
+func startNetemProxy(t *testing.T, config netemConfig) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identify", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method":  "jaguar.identify",
+			"payload": map[string]interface{}{"name": "test", "address": "http://device"},
+		})
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// The body must be read before writing the response.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Write(body)
+	})
+	device := httptest.NewServer(mux)
+	t.Cleanup(device.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- serveNetemProxy(ctx, listener, device.URL, config)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+func TestNetemProxyIdentify(t *testing.T) {
+	proxy := startNetemProxy(t, netemConfig{})
+	res, err := http.Get("http://" + proxy + "/identify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var msg struct {
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if address := msg.Payload["address"]; address != "http://"+proxy {
+		t.Errorf("the proxy announced the address %v, expected http://%s", address, proxy)
+	}
+	if name := msg.Payload["name"]; name != "test" {
+		t.Errorf("the proxy changed the name to %v", name)
+	}
+}
+
+func TestNetemProxyImpaired(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	proxy := startNetemProxy(t, netemConfig{Latency: latency, Loss: 0.1, Seed: 3})
+	data := make([]byte, 16*netemPacketSize+13)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	start := time.Now()
+	res, err := http.Post("http://"+proxy+"/echo", "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("the data was changed on the way")
+	}
+	// The request and the response are each delayed by the latency.
+	if elapsed := time.Since(start); elapsed < 2*latency {
+		t.Errorf("the round trip took %s, expected at least %s", elapsed, 2*latency)
+	}
+}
+
+func TestNetemProxyCutAfter(t *testing.T) {
+	proxy := startNetemProxy(t, netemConfig{CutAfter: 4096})
+	data := make([]byte, 64*1024)
+	res, err := http.Post("http://"+proxy+"/echo", "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		// The request itself was cut.
+		return
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err == nil && len(body) == len(data) {
+		t.Errorf("the connection was not cut after 4096 bytes")
+	}
+}
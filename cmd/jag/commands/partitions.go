@@ -0,0 +1,454 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"github.com/toitlang/jaguar/cmd/jag/esploader"
+)
+
+const (
+	partitionTableOffset = 0x8000
+	// The partition table binary takes up this much space, but the
+	// region reserved for it is a full flash sector.
+	partitionTableSize     = 0x0c00
+	partitionTableReserved = 0x1000
+
+	appPartitionAlignment  = 0x10000
+	dataPartitionAlignment = 0x1000
+)
+
+type Partition struct {
+	Name    string
+	Type    string
+	SubType string
+	Offset  int
+	Size    int
+	Flags   string
+
+	// The bootloader and the partition table itself are not listed in
+	// partitions.csv, but we treat them as partitions for the purpose
+	// of validating the layout.
+	builtin bool
+}
+
+func (p Partition) End() int {
+	return p.Offset + p.Size
+}
+
+type PartitionTable struct {
+	// Where the partitions were loaded from.
+	Source     string
+	Partitions []Partition
+}
+
+var partitionTypes = map[string]byte{
+	"app":  0x00,
+	"data": 0x01,
+}
+
+var partitionSubTypes = map[string]map[string]byte{
+	"app": {
+		"factory": 0x00,
+		"test":    0x20,
+	},
+	"data": {
+		"ota":      0x00,
+		"phy":      0x01,
+		"nvs":      0x02,
+		"coredump": 0x03,
+		"nvs_keys": 0x04,
+		"efuse":    0x05,
+		"esphttpd": 0x80,
+		"fat":      0x81,
+		"spiffs":   0x82,
+	},
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		partitionSubTypes["app"][fmt.Sprintf("ota_%d", i)] = byte(0x10 + i)
+	}
+}
+
+// parsePartitionSize parses offsets and sizes in partitions.csv. They
+// are either numbers (decimal or hex) or numbers with a K or M suffix.
+func parsePartitionSize(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "K") || strings.HasSuffix(s, "k"):
+		multiplier = 1024
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "M") || strings.HasSuffix(s, "m"):
+		multiplier = 1024 * 1024
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 0, 32)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+	return int(n) * multiplier, nil
+}
+
+func alignUp(n int, alignment int) int {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+// newPartitionTable returns a table with just the built-in partitions.
+func newPartitionTable(source string, chip *esploader.Chip) *PartitionTable {
+	return &PartitionTable{
+		Source: source,
+		Partitions: []Partition{
+			{
+				Name:    "bootloader",
+				Offset:  int(chip.BootloaderOffset),
+				Size:    partitionTableOffset - int(chip.BootloaderOffset),
+				builtin: true,
+			},
+			{
+				Name:    "partitions",
+				Offset:  partitionTableOffset,
+				Size:    partitionTableReserved,
+				builtin: true,
+			},
+		},
+	}
+}
+
+// ParsePartitions parses a partitions.csv file in the format used by the
+// ESP-IDF. Partitions without an offset are placed right after the
+// previous partition. The bootloader and the partition table are added
+// as built-in partitions.
+func ParsePartitions(r io.Reader, source string, chip *esploader.Chip) (*PartitionTable, error) {
+	res := newPartitionTable(source, chip)
+	scanner := bufio.NewScanner(r)
+	next := partitionTableOffset + partitionTableReserved
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s:%d: expected at least 5 fields, got %d", source, line, len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		p := Partition{
+			Name:    fields[0],
+			Type:    fields[1],
+			SubType: fields[2],
+		}
+		if len(fields) > 5 {
+			p.Flags = fields[5]
+		}
+		if p.Name == "" {
+			return nil, fmt.Errorf("%s:%d: missing partition name", source, line)
+		}
+		if _, ok := partitionTypes[p.Type]; !ok {
+			if _, err := strconv.ParseUint(p.Type, 0, 8); err != nil {
+				return nil, fmt.Errorf("%s:%d: unknown partition type '%s'", source, line, p.Type)
+			}
+		}
+
+		var err error
+		if fields[3] == "" {
+			alignment := dataPartitionAlignment
+			if p.Type == "app" {
+				alignment = appPartitionAlignment
+			}
+			p.Offset = alignUp(next, alignment)
+		} else if p.Offset, err = parsePartitionSize(fields[3]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad offset for partition '%s': %w", source, line, p.Name, err)
+		}
+		if p.Size, err = parsePartitionSize(fields[4]); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad size for partition '%s': %w", source, line, p.Name, err)
+		}
+		next = p.End()
+		res.Partitions = append(res.Partitions, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", source, err)
+	}
+	return res, nil
+}
+
+// ParsePartitionsBinary parses a partition table in the binary format the
+// bootloader reads from flash, like the one read back from a device.
+func ParsePartitionsBinary(data []byte, source string, chip *esploader.Chip) (*PartitionTable, error) {
+	const (
+		entryMagic = 0xaa50
+		entrySize  = 32
+		labelSize  = 16
+	)
+	res := newPartitionTable(source, chip)
+	for pos := 0; pos+entrySize <= len(data); pos += entrySize {
+		entry := data[pos : pos+entrySize]
+		if binary.LittleEndian.Uint16(entry) != entryMagic {
+			// The table ends with an MD5 entry or with erased flash.
+			break
+		}
+
+		p := Partition{
+			Type:    fmt.Sprintf("0x%02x", entry[2]),
+			SubType: fmt.Sprintf("0x%02x", entry[3]),
+			Offset:  int(binary.LittleEndian.Uint32(entry[4:])),
+			Size:    int(binary.LittleEndian.Uint32(entry[8:])),
+			Name:    strings.TrimRight(string(entry[12:12+labelSize]), "\x00"),
+		}
+		for name, value := range partitionTypes {
+			if value == entry[2] {
+				p.Type = name
+			}
+		}
+		for name, value := range partitionSubTypes[p.Type] {
+			if value == entry[3] {
+				p.SubType = name
+			}
+		}
+		if binary.LittleEndian.Uint32(entry[28:])&1 != 0 {
+			p.Flags = "encrypted"
+		}
+		res.Partitions = append(res.Partitions, p)
+	}
+
+	if len(res.Partitions) == 2 {
+		return nil, fmt.Errorf("no partition table found in %s", source)
+	}
+	return res, nil
+}
+
+// Find returns the partition with the given subtype, or with the given
+// name if there is no partition with that subtype.
+func (t *PartitionTable) Find(key string) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.SubType == key {
+			return p, true
+		}
+	}
+	for _, p := range t.Partitions {
+		if p.Name == key {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// Validate checks that the partitions are properly aligned, do not overlap
+// and fit in the flash. The flash size is only checked if it is non-zero.
+func (t *PartitionTable) Validate(flashSize int) error {
+	var errs []string
+	names := map[string]bool{}
+	for i, p := range t.Partitions {
+		if names[p.Name] {
+			errs = append(errs, fmt.Sprintf("partition '%s' is defined more than once", p.Name))
+		}
+		names[p.Name] = true
+
+		if p.Size <= 0 {
+			errs = append(errs, fmt.Sprintf("partition '%s' has no size", p.Name))
+		}
+		if !p.builtin {
+			alignment := dataPartitionAlignment
+			if p.Type == "app" {
+				alignment = appPartitionAlignment
+			}
+			if p.Offset%alignment != 0 {
+				errs = append(errs, fmt.Sprintf("partition '%s' at 0x%x is not aligned to 0x%x", p.Name, p.Offset, alignment))
+			}
+		}
+		if flashSize > 0 && p.End() > flashSize {
+			errs = append(errs, fmt.Sprintf("partition '%s' ends at 0x%x, beyond the end of the %dMB flash", p.Name, p.End(), flashSize>>20))
+		}
+		for _, other := range t.Partitions[:i] {
+			if p.Offset < other.End() && other.Offset < p.End() {
+				errs = append(errs, fmt.Sprintf("partition '%s' (0x%x-0x%x) overlaps '%s' (0x%x-0x%x)",
+					p.Name, p.Offset, p.End(), other.Name, other.Offset, other.End()))
+			}
+		}
+	}
+
+	if _, ok := t.Find("ota_0"); !ok {
+		errs = append(errs, "there is no ota_0 partition for the Jaguar firmware")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid partition table '%s':\n  %s", t.Source, strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Binary encodes the partition table in the binary format the bootloader
+// reads from flash.
+func (t *PartitionTable) Binary() ([]byte, error) {
+	const (
+		entryMagic = 0xaa50
+		md5Magic   = 0xebeb
+		labelSize  = 16
+	)
+	var buf bytes.Buffer
+	for _, p := range t.Partitions {
+		if p.builtin {
+			continue
+		}
+		partitionType, ok := partitionTypes[p.Type]
+		if !ok {
+			n, err := strconv.ParseUint(p.Type, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unknown partition type '%s'", p.Type)
+			}
+			partitionType = byte(n)
+		}
+		subType, ok := partitionSubTypes[p.Type][p.SubType]
+		if !ok {
+			n, err := strconv.ParseUint(p.SubType, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unknown subtype '%s' for partition '%s'", p.SubType, p.Name)
+			}
+			subType = byte(n)
+		}
+		if len(p.Name) > labelSize {
+			return nil, fmt.Errorf("partition name '%s' is longer than %d characters", p.Name, labelSize)
+		}
+		flags := uint32(0)
+		if strings.Contains(p.Flags, "encrypted") {
+			flags |= 1
+		}
+
+		entry := make([]byte, 32)
+		binary.LittleEndian.PutUint16(entry[0:], entryMagic)
+		entry[2] = partitionType
+		entry[3] = subType
+		binary.LittleEndian.PutUint32(entry[4:], uint32(p.Offset))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(p.Size))
+		copy(entry[12:12+labelSize], p.Name)
+		binary.LittleEndian.PutUint32(entry[28:], flags)
+		buf.Write(entry)
+	}
+
+	digest := md5.Sum(buf.Bytes())
+	entry := bytes.Repeat([]byte{0xff}, 32)
+	binary.LittleEndian.PutUint16(entry[0:], md5Magic)
+	copy(entry[16:], digest[:])
+	buf.Write(entry)
+
+	if buf.Len() > partitionTableSize {
+		return nil, fmt.Errorf("partition table has too many entries")
+	}
+	buf.Write(bytes.Repeat([]byte{0xff}, partitionTableSize-buf.Len()))
+	return buf.Bytes(), nil
+}
+
+// loadPartitionTable loads the partitions.csv given through the
+// '--partitions' flag or the default one for the chip. It reports
+// whether the table is a custom one.
+func loadPartitionTable(cmd *cobra.Command, chip *esploader.Chip) (*PartitionTable, bool, error) {
+	custom := cmd.Flags().Changed("partitions")
+	var path string
+	if custom {
+		var err error
+		if path, err = cmd.Flags().GetString("partitions"); err != nil {
+			return nil, false, err
+		}
+	} else {
+		toitToolchainPath, err := directory.GetChipToolchainPath(chip.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		path = filepath.Join(toitToolchainPath, "partitions.csv")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not open partition table: %w", err)
+	}
+	defer file.Close()
+
+	table, err := ParsePartitions(file, path, chip)
+	if err != nil {
+		return nil, false, err
+	}
+	return table, custom, nil
+}
+
+func PartitionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "partitions",
+		Short: "Show the flash partition layout used when flashing",
+		Long: "Show the flash partition layout used by 'jag flash'. The layout is read\n" +
+			"from the partitions.csv for the chip or from the file given with\n" +
+			"'--partitions' and it is validated before it is shown.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chipName, err := cmd.Flags().GetString("chip")
+			if err != nil {
+				return err
+			}
+			chip, err := firmwareChipByName(chipName)
+			if err != nil {
+				return err
+			}
+
+			flashSize := 0
+			if cmd.Flags().Changed("flash-size") {
+				size, err := cmd.Flags().GetString("flash-size")
+				if err != nil {
+					return err
+				}
+				s, err := esploader.ParseFlashSize(size)
+				if err != nil {
+					return err
+				}
+				flashSize = int(s)
+			}
+
+			table, _, err := loadPartitionTable(cmd, chip)
+			if err != nil {
+				return err
+			}
+
+			nameLength := len("NAME")
+			for _, p := range table.Partitions {
+				nameLength = max(nameLength, len(p.Name))
+			}
+
+			fmt.Println(padded("NAME", nameLength) + padded("TYPE", 4) + padded("SUBTYPE", 8) + padded("OFFSET", 9) + padded("SIZE", 9) + "END")
+			for _, p := range table.Partitions {
+				partitionType, subType := p.Type, p.SubType
+				if p.builtin {
+					partitionType, subType = "-", "-"
+				}
+				fmt.Println(padded(p.Name, nameLength) +
+					padded(partitionType, 4) +
+					padded(subType, 8) +
+					padded(fmt.Sprintf("0x%x", p.Offset), 9) +
+					padded(fmt.Sprintf("0x%x", p.Size), 9) +
+					fmt.Sprintf("0x%x", p.End()))
+			}
+
+			return table.Validate(flashSize)
+		},
+	}
+
+	cmd.Flags().String("chip", "esp32", "chip to show the layout for ("+strings.Join(esploader.ChipNames(), ", ")+")")
+	cmd.Flags().String("partitions", "", "path to a custom partitions.csv")
+	cmd.Flags().String("flash-size", "", "check that the partitions fit in flash of this size (e.g. 4MB)")
+	return cmd
+}
@@ -14,6 +14,12 @@ import (
 	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	// The serial number of the USB device the port is pinned to.
+	PortUSBSerialCfgKey = "port-usb-serial"
 )
 
 func PortCmd() *cobra.Command {
@@ -38,6 +44,10 @@ func PortCmd() *cobra.Command {
 				if err != nil {
 					return err
 				}
+				if _, ok := outputter.(*shortEncoder); ok {
+					ports.print()
+					return nil
+				}
 				return outputter.Encode(ports)
 			}
 
@@ -46,6 +56,14 @@ func PortCmd() *cobra.Command {
 				return err
 			}
 
+			if usbSerial := cfg.GetString(PortUSBSerialCfgKey); usbSerial != "" {
+				port, ok := findPortByUSBSerial(usbSerial)
+				if !ok {
+					return fmt.Errorf("the device with USB serial number '%s' is not connected", usbSerial)
+				}
+				fmt.Printf("%s (USB serial number %s)\n", port, usbSerial)
+				return nil
+			}
 			if !cfg.IsSet("port") {
 				return fmt.Errorf("port was not set, use 'jag port set' to pick a port")
 			}
@@ -57,14 +75,19 @@ func PortCmd() *cobra.Command {
 	cmd.AddCommand(PortSetCmd())
 	cmd.Flags().BoolP("list", "l", false, "If set, list the ports")
 	cmd.Flags().StringP("output", "o", "short", "Set output format to json, yaml or short (works only with '--list')")
-	cmd.Flags().Bool("all", false, "if set, will show all available ports")
+	cmd.Flags().Bool("all", false, "if set, will show all available ports and not only the ones with known ESP32 USB-UART bridges")
 	return cmd
 }
 
 func PortSetCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "set [<port>]",
-		Short:        "Select the serial port you want to use",
+		Use:   "set [<port>]",
+		Short: "Select the serial port you want to use",
+		Long: "Select the serial port you want to use.\n\n" +
+			"Ports can change name when a device is plugged in again. With '--by-serial'\n" +
+			"the port is pinned by the serial number of the USB device behind it, so the\n" +
+			"same device is used no matter what the port is called. You can also pin a\n" +
+			"device directly with '--usb-serial <serial number>'.",
 		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -73,25 +96,91 @@ func PortSetCmd() *cobra.Command {
 				return err
 			}
 
+			bySerial, err := cmd.Flags().GetBool("by-serial")
+			if err != nil {
+				return err
+			}
+
+			usbSerial, err := cmd.Flags().GetString("usb-serial")
+			if err != nil {
+				return err
+			}
+
 			cfg, err := directory.GetDeviceConfig()
 			if err != nil {
 				return err
 			}
 
+			if usbSerial != "" {
+				if len(args) == 1 {
+					return fmt.Errorf("give either a port or --usb-serial, not both")
+				}
+				port, ok := findPortByUSBSerial(usbSerial)
+				if !ok {
+					return fmt.Errorf("found no port with USB serial number '%s', use 'jag port --list' to see the connected devices", usbSerial)
+				}
+				return setPort(cfg, port, true)
+			}
+
 			if len(args) == 1 {
-				cfg.Set("port", args[0])
-				return cfg.WriteConfig()
+				return setPort(cfg, args[0], bySerial)
 			}
 
-			_, err = GetPort(cfg, all, true)
-			return err
+			port, err := pickPort(all)
+			if err != nil {
+				return err
+			}
+			return setPort(cfg, port, bySerial)
 		},
 	}
 
-	cmd.Flags().Bool("all", false, "if set, will show all available ports")
+	cmd.Flags().Bool("all", false, "if set, will show all available ports and not only the ones with known ESP32 USB-UART bridges")
+	cmd.Flags().Bool("by-serial", false, "pin the port by the serial number of the USB device")
+	cmd.Flags().String("usb-serial", "", "pin the port of the USB device with the given serial number")
 	return cmd
 }
 
+// setPort stores the port to use. If pin is set, we also store the
+// serial number of the USB device, so we can find the port again if it
+// changes name.
+func setPort(cfg *viper.Viper, port string, pin bool) error {
+	cfg.Set("port", port)
+	if pin {
+		usbSerial := usbSerialNumber(port)
+		if usbSerial == "" {
+			return fmt.Errorf("the serial number of the USB device behind '%s' is not known, so it cannot be pinned", port)
+		}
+		cfg.Set(PortUSBSerialCfgKey, usbSerial)
+		fmt.Printf("Pinned the USB device with serial number '%s' (currently '%s')\n", usbSerial, port)
+	} else {
+		cfg.Set(PortUSBSerialCfgKey, "")
+	}
+	return cfg.WriteConfig()
+}
+
+// findPortByUSBSerial returns the port of the USB device with the given
+// serial number.
+func findPortByUSBSerial(usbSerial string) (string, bool) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", false
+	}
+	var res []string
+	for _, d := range details {
+		if d.IsUSB && d.SerialNumber == usbSerial {
+			res = append(res, d.Name)
+		}
+	}
+	if len(res) == 0 {
+		return "", false
+	}
+	// On macOS the same device shows up as both /dev/cu.* and /dev/tty.*.
+	if runtime.GOOS == "darwin" {
+		res = darwinFilterPaths(res)
+	}
+	return res[0], true
+}
+
 func PortExists(port string) (bool, error) {
 	ports, err := serial.GetPortsList()
 	if err != nil {
@@ -105,11 +194,31 @@ func PortExists(port string) (bool, error) {
 	return false, nil
 }
 
+// usbSerialNumber returns the serial number of the USB device behind the
+// serial port or the empty string if it is not known.
+func usbSerialNumber(port string) string {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return ""
+	}
+	for _, d := range details {
+		if d.Name == port && d.IsUSB {
+			return d.SerialNumber
+		}
+	}
+	return ""
+}
+
 func ConfiguredPort() string {
 	cfg, err := directory.GetDeviceConfig()
 	if err != nil {
 		return ""
 	}
+	if usbSerial := cfg.GetString(PortUSBSerialCfgKey); usbSerial != "" {
+		if port, ok := findPortByUSBSerial(usbSerial); ok {
+			return port
+		}
+	}
 	return cfg.GetString("port")
 }
 
@@ -148,10 +257,58 @@ func pickPort(all bool) (string, error) {
 		return "", fmt.Errorf("you didn't select anything")
 	}
 
-	return string(ports.Ports[i]), nil
+	return ports.Ports[i].Name, nil
+}
+
+// knownBridges are the USB VID:PID pairs of the USB-UART bridges and
+// the built-in USB interfaces found on ESP32 boards.
+var knownBridges = map[string]string{
+	"10C4:EA60": "Silicon Labs CP210x",
+	"1A86:7523": "WCH CH340",
+	"1A86:55D3": "WCH CH343",
+	"1A86:55D4": "WCH CH9102",
+	"0403:6001": "FTDI FT232R",
+	"0403:6010": "FTDI FT2232",
+	"0403:6014": "FTDI FT232H",
+	"0403:6015": "FTDI FT231X",
+	"067B:2303": "Prolific PL2303",
+	"303A:0002": "Espressif USB CDC",
+	"303A:1001": "Espressif USB-Serial/JTAG",
 }
 
 func getPorts(all bool) (Ports, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		// Without the USB details, we can only go by the names of the
+		// ports.
+		return getPortsByName(all)
+	}
+
+	byName := map[string]*enumerator.PortDetails{}
+	var names []string
+	for _, d := range details {
+		if !all && !d.IsUSB {
+			continue
+		}
+		port := portFromDetails(d)
+		if !all && port.Bridge == "" {
+			continue
+		}
+		byName[d.Name] = d
+		names = append(names, d.Name)
+	}
+	if !all && runtime.GOOS == "darwin" {
+		names = darwinFilterPaths(names)
+	}
+
+	var res Ports
+	for _, name := range names {
+		res.Ports = append(res.Ports, portFromDetails(byName[name]))
+	}
+	return res, nil
+}
+
+func getPortsByName(all bool) (Ports, error) {
 	ports, err := serial.GetPortsList()
 	if err != nil {
 		return Ports{}, err
@@ -162,11 +319,28 @@ func getPorts(all bool) (Ports, error) {
 
 	var res Ports
 	for _, p := range ports {
-		res.Ports = append(res.Ports, Port(p))
+		res.Ports = append(res.Ports, Port{Name: p})
 	}
 	return res, nil
 }
 
+func portFromDetails(d *enumerator.PortDetails) Port {
+	res := Port{
+		Name: d.Name,
+		USB:  d.IsUSB,
+	}
+	if !d.IsUSB {
+		return res
+	}
+	// The case of the ids depends on the platform.
+	res.VID = strings.ToUpper(d.VID)
+	res.PID = strings.ToUpper(d.PID)
+	res.Product = d.Product
+	res.SerialNumber = d.SerialNumber
+	res.Bridge = knownBridges[res.VID+":"+res.PID]
+	return res
+}
+
 func filterPorts(ports []string) []string {
 	switch runtime.GOOS {
 	case "darwin":
@@ -210,7 +384,12 @@ func linuxFilterPaths(paths []string) []string {
 }
 
 func GetPort(cfg *viper.Viper, all bool, reset bool) (string, error) {
-	if !reset && cfg.IsSet("port") {
+	if usbSerial := cfg.GetString(PortUSBSerialCfgKey); !reset && usbSerial != "" {
+		if port, ok := findPortByUSBSerial(usbSerial); ok {
+			return port, nil
+		}
+		fmt.Printf("The device with USB serial number '%s' is not connected.\n", usbSerial)
+	} else if !reset && cfg.IsSet("port") {
 		port := cfg.GetString("port")
 		exists, err := PortExists(port)
 		if err != nil {
@@ -225,8 +404,14 @@ func GetPort(cfg *viper.Viper, all bool, reset bool) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	cfg.Set("port", port)
-	if err := cfg.WriteConfig(); err != nil {
+	// The pinned device may just have been unplugged for a moment, so we
+	// only drop the pin if the user picks another device.
+	pinned := cfg.GetString(PortUSBSerialCfgKey)
+	pin := pinned != "" && usbSerialNumber(port) == pinned
+	if pinned != "" && !pin {
+		fmt.Printf("No longer pinning the USB device with serial number '%s'.\n", pinned)
+	}
+	if err := setPort(cfg, port, pin); err != nil {
 		return "", err
 	}
 	return port, nil
@@ -236,14 +421,37 @@ type Ports struct {
 	Ports []Port `mapstructure:"ports" yaml:"ports" json:"ports"`
 }
 
-type Port string
+type Port struct {
+	Name         string `mapstructure:"name" yaml:"name" json:"name"`
+	USB          bool   `mapstructure:"usb" yaml:"usb" json:"usb"`
+	VID          string `mapstructure:"vid" yaml:"vid,omitempty" json:"vid,omitempty"`
+	PID          string `mapstructure:"pid" yaml:"pid,omitempty" json:"pid,omitempty"`
+	Product      string `mapstructure:"product" yaml:"product,omitempty" json:"product,omitempty"`
+	SerialNumber string `mapstructure:"serialNumber" yaml:"serialNumber,omitempty" json:"serialNumber,omitempty"`
+	// The kind of USB-UART bridge, if it is one we know from ESP32 boards.
+	Bridge string `mapstructure:"bridge" yaml:"bridge,omitempty" json:"bridge,omitempty"`
+}
 
 func (p Port) Short() string {
-	return string(p)
+	return p.Name
 }
 
+// String is used when picking a port, so it includes enough details to
+// tell the ports apart.
 func (p Port) String() string {
-	return string(p)
+	var details []string
+	if p.Product != "" {
+		details = append(details, p.Product)
+	} else if p.Bridge != "" {
+		details = append(details, p.Bridge)
+	}
+	if p.SerialNumber != "" {
+		details = append(details, "serial "+p.SerialNumber)
+	}
+	if len(details) == 0 {
+		return p.Name
+	}
+	return fmt.Sprintf("%s (%s)", p.Name, strings.Join(details, ", "))
 }
 
 func (p Ports) Len() int {
@@ -257,3 +465,26 @@ func (p Ports) Elements() []Short {
 	}
 	return res
 }
+
+func (p Ports) print() {
+	nameLength, productLength := len("PORT"), len("PRODUCT")
+	for _, port := range p.Ports {
+		nameLength = max(nameLength, len(port.Name))
+		productLength = max(productLength, len(port.product()))
+	}
+	fmt.Println(padded("PORT", nameLength) + padded("VID:PID", 9) + padded("PRODUCT", productLength) + "SERIAL")
+	for _, port := range p.Ports {
+		id := "-"
+		if port.USB {
+			id = port.VID + ":" + port.PID
+		}
+		fmt.Println(padded(port.Name, nameLength) + padded(id, 9) + padded(port.product(), productLength) + port.SerialNumber)
+	}
+}
+
+func (p Port) product() string {
+	if p.Product != "" {
+		return p.Product
+	}
+	return p.Bridge
+}
@@ -0,0 +1,358 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Scanning for all devices takes longer than scanning for a single
+	// one, as we want to hear from every device on the network.
+	rolloutScanTimeout = 2 * time.Second
+	// How long to wait for a device to come back after sending it new
+	// firmware.
+	firmwareVerifyTimeout = 3 * time.Minute
+)
+
+// rolloutEntry is a device that is part of a firmware rollout together
+// with the outcome of updating it.
+type rolloutEntry struct {
+	Name          string `json:"name"`
+	OldID         string `json:"oldId"`
+	NewID         string `json:"newId,omitempty"`
+	Address       string `json:"address"`
+	OldSDKVersion string `json:"oldSdkVersion"`
+	SDKVersion    string `json:"sdkVersion,omitempty"`
+	Wave          int    `json:"wave,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+
+	device *Device
+}
+
+const (
+	rolloutStatusUpdated   = "updated"
+	rolloutStatusFailed    = "failed"
+	rolloutStatusUpToDate  = "up-to-date"
+	rolloutStatusSkipped   = "skipped"
+	rolloutStatusScheduled = "scheduled"
+)
+
+func addRolloutFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("all", false, "update all devices found on the network")
+	cmd.Flags().String("match", "", "update the devices found on the network with names matching a pattern (e.g. 'lab-*')")
+	cmd.Flags().Int("canary", 1, "number of devices in the first wave")
+	cmd.Flags().Int("wave-percent", 25, "percentage of the devices in each of the following waves")
+	cmd.Flags().Int("max-failures", 0, "stop the rollout when more devices than this fail")
+	cmd.Flags().Duration("verify-timeout", firmwareVerifyTimeout, "how long to wait for an updated device to come back")
+	cmd.Flags().Bool("force", false, "also update devices that already run the current SDK version")
+	cmd.Flags().String("report", "", "write the outcome of the rollout to a file (.json or .csv)")
+}
+
+// rolloutDevices finds the devices to roll out to. Devices found by
+// scanning come first, followed by the explicitly selected devices.
+func rolloutDevices(cmd *cobra.Command, cfg *viper.Viper, sdk *SDK, deviceSelects []deviceSelect) ([]*Device, error) {
+	ctx := cmd.Context()
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return nil, err
+	}
+	match, err := cmd.Flags().GetString("match")
+	if err != nil {
+		return nil, err
+	}
+	if match != "" {
+		if _, err := path.Match(match, ""); err != nil {
+			return nil, fmt.Errorf("invalid --match pattern '%s': %w", match, err)
+		}
+	}
+
+	var res []*Device
+	seen := map[string]bool{}
+	if all || match != "" {
+		scanCtx, cancel := context.WithTimeout(ctx, rolloutScanTimeout)
+		devices, err := scan(scanCtx, nil, scanPort)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for i := range devices {
+			d := devices[i]
+			if match != "" {
+				if ok, _ := path.Match(match, d.Name); !ok {
+					continue
+				}
+			}
+			seen[d.ID] = true
+			res = append(res, &d)
+		}
+	}
+
+	for _, ds := range deviceSelects {
+		d, err := GetDevice(ctx, cfg, sdk, true, ds)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[d.ID] {
+			seen[d.ID] = true
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// rolloutWaves splits the entries into waves. The first wave has the
+// canary devices, and the following waves each have the given percentage
+// of all the devices, but at least one.
+func rolloutWaves(entries []*rolloutEntry, canary int, percent int) [][]*rolloutEntry {
+	waveSize := (len(entries)*percent + 99) / 100
+	if waveSize < 1 {
+		waveSize = 1
+	}
+
+	var res [][]*rolloutEntry
+	if canary > 0 {
+		if canary > len(entries) {
+			canary = len(entries)
+		}
+		res = append(res, entries[:canary])
+		entries = entries[canary:]
+	}
+	for len(entries) > 0 {
+		size := waveSize
+		if size > len(entries) {
+			size = len(entries)
+		}
+		res = append(res, entries[:size])
+		entries = entries[size:]
+	}
+	for i, wave := range res {
+		for _, entry := range wave {
+			entry.Wave = i + 1
+		}
+	}
+	return res
+}
+
+func rolloutFirmware(cmd *cobra.Command, cfg *viper.Viper, sdk *SDK, wifi *wifiConfig, deviceSelects []deviceSelect) error {
+	ctx := cmd.Context()
+
+	canary, err := cmd.Flags().GetInt("canary")
+	if err != nil {
+		return err
+	}
+	if canary < 0 {
+		return fmt.Errorf("--canary cannot be negative")
+	}
+
+	percent, err := cmd.Flags().GetInt("wave-percent")
+	if err != nil {
+		return err
+	}
+	if percent < 1 || percent > 100 {
+		return fmt.Errorf("--wave-percent must be between 1 and 100")
+	}
+
+	maxFailures, err := cmd.Flags().GetInt("max-failures")
+	if err != nil {
+		return err
+	}
+
+	verifyTimeout, err := cmd.Flags().GetDuration("verify-timeout")
+	if err != nil {
+		return err
+	}
+
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+
+	reportPath, err := cmd.Flags().GetString("report")
+	if err != nil {
+		return err
+	}
+
+	devices, err := rolloutDevices(cmd, cfg, sdk, deviceSelects)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("found no devices to update")
+	}
+
+	var entries, pending []*rolloutEntry
+	for _, d := range devices {
+		entry := &rolloutEntry{
+			Name:          d.Name,
+			OldID:         d.ID,
+			Address:       d.Address,
+			OldSDKVersion: d.SDKVersion,
+			device:        d,
+		}
+		entries = append(entries, entry)
+		if d.SDKVersion == sdk.Version && !force {
+			entry.Status = rolloutStatusUpToDate
+			continue
+		}
+		entry.Status = rolloutStatusScheduled
+		pending = append(pending, entry)
+	}
+
+	waves := rolloutWaves(pending, canary, percent)
+	fmt.Printf("Updating %d of %d devices to Toit SDK %s in %d waves\n", len(pending), len(entries), sdk.Version, len(waves))
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listener, err := listenForIdentify(listenCtx, scanPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for devices: %w", err)
+	}
+
+	failed := 0
+	halted := false
+	for i, wave := range waves {
+		if halted {
+			for _, entry := range wave {
+				entry.Status = rolloutStatusSkipped
+			}
+			continue
+		}
+
+		fmt.Printf("\nWave %d of %d: updating %d devices ...\n", i+1, len(waves), len(wave))
+		var wg sync.WaitGroup
+		for _, entry := range wave {
+			wg.Add(1)
+			go func(entry *rolloutEntry) {
+				defer wg.Done()
+				if err := updateAndVerify(ctx, sdk, wifi, listener, entry, verifyTimeout); err != nil {
+					entry.Status = rolloutStatusFailed
+					entry.Error = err.Error()
+					fmt.Printf("[%s] Failed: %v\n", entry.Name, err)
+					return
+				}
+				entry.Status = rolloutStatusUpdated
+				fmt.Printf("[%s] Updated and back at %s\n", entry.Name, entry.Address)
+			}(entry)
+		}
+		wg.Wait()
+
+		for _, entry := range wave {
+			if entry.Status == rolloutStatusFailed {
+				failed++
+			}
+		}
+		if failed > maxFailures {
+			fmt.Printf("\n%d devices failed, which is more than the %d allowed. Stopping the rollout.\n", failed, maxFailures)
+			halted = true
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Status == rolloutStatusUpdated {
+			if err := updateStoredDevice(cfg, entry.OldID, entry.device); err != nil {
+				return err
+			}
+		}
+	}
+
+	nameLength := len("NAME")
+	for _, entry := range entries {
+		nameLength = max(nameLength, len(entry.Name))
+	}
+	fmt.Println()
+	fmt.Println(padded("NAME", nameLength) + padded("WAVE", 4) + padded("SDK", 12) + "STATUS")
+	for _, entry := range entries {
+		wave := "-"
+		if entry.Wave > 0 {
+			wave = fmt.Sprint(entry.Wave)
+		}
+		sdkVersion := entry.SDKVersion
+		if sdkVersion == "" {
+			sdkVersion = entry.OldSDKVersion
+		}
+		fmt.Println(padded(entry.Name, nameLength) + padded(wave, 4) + padded(sdkVersion, 12) + entry.Status)
+	}
+
+	if reportPath != "" {
+		var rows [][]string
+		for _, entry := range entries {
+			rows = append(rows, []string{entry.Name, entry.OldID, entry.NewID, entry.Address, entry.OldSDKVersion, entry.SDKVersion, fmt.Sprint(entry.Wave), entry.Status, entry.Error})
+		}
+		header := []string{"name", "old-id", "new-id", "address", "old-sdk-version", "sdk-version", "wave", "status", "error"}
+		if err := writeReport(reportPath, entries, header, rows); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote report to '%s'\n", reportPath)
+	}
+
+	if halted {
+		return fmt.Errorf("rollout stopped after %d failures", failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(pending))
+	}
+	return nil
+}
+
+// updateAndVerify updates the firmware on the device of the entry and
+// waits for it to come back with the new ID and SDK version.
+func updateAndVerify(ctx context.Context, sdk *SDK, wifi *wifiConfig, listener *identifyListener, entry *rolloutEntry, timeout time.Duration) error {
+	device := entry.device
+	bin, newID, chip, err := buildFirmwareForDevice(ctx, device, wifi)
+	if err != nil {
+		return fmt.Errorf("failed to build firmware: %w", err)
+	}
+	entry.NewID = newID
+
+	fmt.Printf("[%s] Sending firmware ...\n", entry.Name)
+	if err := device.UpdateFirmware(ctx, sdk, bin, true); err != nil {
+		return fmt.Errorf("failed to send firmware: %w", err)
+	}
+
+	// A device that fails to boot the new firmware rolls back to the old
+	// one and keeps announcing itself with the old ID.
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	updated, err := listener.waitFor(waitCtx, newID)
+	if err != nil {
+		return fmt.Errorf("device did not come back with the new firmware within %s", timeout)
+	}
+	entry.SDKVersion = updated.SDKVersion
+	entry.Address = updated.Address
+	if updated.SDKVersion != sdk.Version {
+		return fmt.Errorf("device came back with SDK version %s", updated.SDKVersion)
+	}
+	if updated.Chip == "" {
+		updated.Chip = chip
+	}
+	if !updated.Ping(ctx, sdk) {
+		return fmt.Errorf("device did not answer ping after the update")
+	}
+	entry.device = updated
+	return nil
+}
+
+// updateStoredDevice replaces the device used by default if it had the
+// given ID, as devices get a new ID when their firmware is updated.
+func updateStoredDevice(cfg *viper.Viper, oldID string, device *Device) error {
+	if !cfg.IsSet("device") {
+		return nil
+	}
+	var d Device
+	if err := cfg.UnmarshalKey("device", &d); err != nil || d.ID != oldID {
+		return nil
+	}
+	cfg.Set("device", device)
+	return cfg.WriteConfig()
+}
@@ -13,6 +13,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/setanta314/ar"
@@ -88,7 +90,10 @@ func RunCmd() *cobra.Command {
 			"device is already executing another program, that program is stopped before\n" +
 			"the new program is started.\n" +
 			"If you specify the device to be 'host' with the option '-d host', then the\n" +
-			"program runs on the current computer instead.",
+			"program runs on the current computer instead.\n" +
+			"Use '-s <expression>' instead of a file to evaluate a Toit expression on the\n" +
+			"device and print its value. The modules the expression needs can be imported\n" +
+			"with '-i', like in 'jag run -i gpio -s \"(gpio.Pin 2).get\"'.",
 		Args:         cobra.MinimumNArgs(0),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -99,34 +104,64 @@ func RunCmd() *cobra.Command {
 				return err
 			}
 
-			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
+			if isHostSelect(deviceSelect) {
 				if cmd.Flags().Changed("define") {
 					return fmt.Errorf("--define/-D is not yet supported when running on host")
 				}
+				if cmd.Flags().Changed("import") {
+					return fmt.Errorf("--import/-i is not yet supported when running on host")
+				}
 				return runOnHost(ctx, cmd, args)
 			}
 
-			if cmd.Flags().Changed("expression") {
-				return fmt.Errorf("--expression/-s is not yet supported when running on devices")
+			expression, err := cmd.Flags().GetString("expression")
+			if err != nil {
+				return err
 			}
 
-			cfg, err := directory.GetDeviceConfig()
+			imports, err := cmd.Flags().GetStringArray("import")
 			if err != nil {
 				return err
 			}
 
-			if len(args) != 1 {
-				return fmt.Errorf("Only one argument can be passed to jag run")
+			if _, err := diagnosticsFormat(cmd); err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
 			}
 
-			entrypoint := args[0]
-			if stat, err := os.Stat(entrypoint); err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+			entrypoint := ""
+			if cmd.Flags().Changed("expression") {
+				if len(args) != 0 {
+					return fmt.Errorf("give either an expression with --expression/-s or a file, not both")
+				}
+				if strings.TrimSpace(expression) == "" {
+					return fmt.Errorf("--expression/-s needs an expression to evaluate")
+				}
+				for _, module := range imports {
+					if strings.TrimSpace(module) == "" || strings.ContainsAny(module, "\r\n") {
+						return fmt.Errorf("invalid --import/-i '%s', it must be a module like 'gpio' or 'encoding.json'", module)
+					}
+				}
+			} else if len(imports) > 0 {
+				return fmt.Errorf("--import/-i can only be used with --expression/-s")
+			} else {
+				if len(args) != 1 {
+					return fmt.Errorf("Only one argument can be passed to jag run")
+				}
+
+				entrypoint = args[0]
+				if stat, err := os.Stat(entrypoint); err != nil {
+					if os.IsNotExist(err) {
+						return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+					}
+					return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
+				} else if stat.IsDir() {
+					return fmt.Errorf("can't run directory: '%s'", entrypoint)
 				}
-				return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
-			} else if stat.IsDir() {
-				return fmt.Errorf("can't run directory: '%s'", entrypoint)
 			}
 
 			sdk, err := GetSDK(ctx)
@@ -139,17 +174,28 @@ func RunCmd() *cobra.Command {
 				return err
 			}
 
+			device, err = checkSDKVersion(cmd, cfg, sdk, device)
+			if err != nil {
+				return err
+			}
+
 			defines, err := parseDefineFlags(cmd, "define")
 			if err != nil {
 				return err
 			}
+			if entrypoint == "" {
+				return RunExpression(cmd, device, sdk, expression, imports, defines)
+			}
 			return RunFile(cmd, device, sdk, entrypoint, defines)
 		},
 	}
 
 	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression")
+	cmd.Flags().StringArrayP("import", "i", nil, "import a module for the expression, like 'gpio' or 'encoding.json show encode' (can be repeated)")
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
+	addUpdateFirmwareFlag(cmd)
+	addDiagnosticsFlag(cmd)
 	return cmd
 }
 
@@ -177,31 +223,71 @@ func runOnHost(ctx context.Context, cmd *cobra.Command, args []string) error {
 }
 
 func RunFile(cmd *cobra.Command, device *Device, sdk *SDK, path string, defines string) error {
-	fmt.Printf("Running '%s' on '%s' ...\n", path, device.Name)
-	return sendCodeFromFile(cmd, device, sdk, "/run", path, "", defines)
+	snapshot, err := compileToCache(cmd, sdk, path, defines)
+	if err != nil {
+		return err
+	}
+	return RunSnapshot(cmd, device, sdk, path, snapshot, defines)
 }
 
 func InstallFile(cmd *cobra.Command, device *Device, sdk *SDK, name string, path string, defines string) error {
+	snapshot, err := compileToCache(cmd, sdk, path, defines)
+	if err != nil {
+		return err
+	}
+	return InstallSnapshot(cmd, device, sdk, name, path, snapshot, defines)
+}
+
+// RunSnapshot runs a snapshot returned by compileToCache for the file at
+// path on the device.
+func RunSnapshot(cmd *cobra.Command, device *Device, sdk *SDK, path string, snapshot string, defines string) error {
+	fmt.Printf("Running '%s' on '%s' ...\n", path, device.Name)
+	return sendSnapshot(cmd, device, sdk, "/run", snapshot, "", defines)
+}
+
+// InstallSnapshot installs a snapshot returned by compileToCache for the
+// file at path as a named container on the device.
+func InstallSnapshot(cmd *cobra.Command, device *Device, sdk *SDK, name string, path string, snapshot string, defines string) error {
 	fmt.Printf("Installing container '%s' from '%s' on '%s' ...\n", name, path, device.Name)
-	return sendCodeFromFile(cmd, device, sdk, "/install", path, name, defines)
+	return sendSnapshot(cmd, device, sdk, "/install", snapshot, name, defines)
 }
 
-func sendCodeFromFile(
-	cmd *cobra.Command,
-	device *Device,
-	sdk *SDK,
-	request string,
-	path string,
-	name string,
-	defines string) error {
+// compileToCache compiles the Toit file at path, unless it already is a
+// snapshot, and returns the path of the snapshot in the snapshots cache.
+// The same snapshot can be sent to several devices. If the file and its
+// dependencies haven't changed since it was last compiled with the same
+// defines, the snapshot from then is used again.
+func compileToCache(cmd *cobra.Command, sdk *SDK, path string, defines string) (string, error) {
+	return compileSnapshot(cmd, sdk, path, defines, true)
+}
+
+// compileSnapshot is like compileToCache, but only uses and remembers the
+// snapshots from earlier runs if remember is set. Generated programs that
+// are only run once don't need to be remembered.
+func compileSnapshot(cmd *cobra.Command, sdk *SDK, path string, defines string, remember bool) (string, error) {
+	snapshot, _, err := compileWithDependencies(cmd, sdk, path, defines, remember)
+	return snapshot, err
+}
 
+// compileWithDependencies is like compileSnapshot, but also returns the
+// files the program depends on, if they are known.
+func compileWithDependencies(cmd *cobra.Command, sdk *SDK, path string, defines string, remember bool) (string, []string, error) {
 	ctx := cmd.Context()
 	snapshotsCache, err := directory.GetSnapshotsCachePath()
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	var snapshot string = ""
+	var dependencies []string
+	var started time.Time
+
+	if remember && !IsSnapshot(path) {
+		if cached, cachedDependencies, ok := lookupCompiled(sdk, snapshotsCache, path, defines); ok {
+			fmt.Printf("Using the snapshot of '%s' from the last run, nothing has changed\n", path)
+			return cached, cachedDependencies, nil
+		}
+	}
 
 	if IsSnapshot(path) {
 		snapshot = path
@@ -210,27 +296,39 @@ func sendCodeFromFile(
 		// snapshot first.
 		tempdir, err := ioutil.TempDir("", "jag_run")
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 		defer os.RemoveAll(tempdir)
 
 		snapshotFile, err := ioutil.TempFile(tempdir, "jag_run_*.snapshot")
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 		snapshot = snapshotFile.Name()
-		err = sdk.Compile(ctx, snapshot, path)
-		if err != nil {
-			// We assume the error has been printed.
+		dependencyFile := filepath.Join(tempdir, "dependencies.txt")
+		started = time.Now()
+		output, err := sdk.CompileWithDiagnostics(ctx, snapshot, path, dependencyFile)
+		if printErr := printDiagnostics(cmd, output); printErr != nil {
+			return "", nil, printErr
+		}
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return "", nil, err
+		} else if err != nil {
+			// The diagnostics have been printed.
 			// Mark the command as silent to avoid printing the error twice.
 			cmd.SilenceErrors = true
-			return err
+			return "", nil, &compileError{path: path, diagnostics: parseDiagnostics(output)}
+		}
+		if dependencies, err = compiledDependencies(dependencyFile, path); err != nil {
+			// We can't tell when to compile again, so we don't remember
+			// the snapshot.
+			dependencies = nil
 		}
 	}
 
 	programId, err := GetUuid(snapshot)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	cacheDestination := filepath.Join(snapshotsCache, programId.String()+".snapshot")
@@ -245,7 +343,7 @@ func sendCodeFromFile(
 		tempFileInCacheDirectory, err := ioutil.TempFile(snapshotsCache, "jag_run_*.snapshot")
 		if err != nil {
 			fmt.Printf("Failed to write temporary file in '%s'\n", snapshotsCache)
-			return err
+			return "", nil, err
 		}
 		defer tempFileInCacheDirectory.Close()
 		defer os.Remove(tempFileInCacheDirectory.Name())
@@ -253,7 +351,7 @@ func sendCodeFromFile(
 		source, err := os.Open(snapshot)
 		if err != nil {
 			fmt.Printf("Failed to read '%s'n", snapshot)
-			return err
+			return "", nil, err
 		}
 		defer source.Close()
 		defer tempFileInCacheDirectory.Close()
@@ -261,18 +359,36 @@ func sendCodeFromFile(
 		_, err = io.Copy(tempFileInCacheDirectory, source)
 		if err != nil {
 			fmt.Printf("Failed to write '%s'n", tempFileInCacheDirectory.Name())
-			return err
+			return "", nil, err
 		}
 		tempFileInCacheDirectory.Close()
 
 		// Atomic move so no other process can see a half-written snapshot file.
 		err = os.Rename(tempFileInCacheDirectory.Name(), cacheDestination)
 		if err != nil {
-			return err
+			return "", nil, err
 		}
 	}
 
-	b, err := sdk.Build(ctx, device, cacheDestination)
+	if remember && len(dependencies) > 0 {
+		if err := storeCompiled(sdk, snapshotsCache, path, defines, dependencies, cacheDestination, started); err != nil {
+			fmt.Printf("Failed to remember the snapshot of '%s': %v\n", path, err)
+		}
+	}
+	return cacheDestination, dependencies, nil
+}
+
+func sendSnapshot(
+	cmd *cobra.Command,
+	device *Device,
+	sdk *SDK,
+	request string,
+	snapshot string,
+	name string,
+	defines string) error {
+
+	ctx := cmd.Context()
+	b, err := sdk.Build(ctx, device, snapshot)
 	if err != nil {
 		// We assume the error has been printed.
 		// Mark the command as silent to avoid printing the error twice.
@@ -0,0 +1,105 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// addUpdateFirmwareFlag adds the '--update-firmware' flag together with
+// the WiFi flags, because the updated firmware needs the WiFi settings.
+func addUpdateFirmwareFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("update-firmware", false, "update the firmware without asking if the device runs another SDK version")
+	addWifiFlags(cmd)
+}
+
+// checkSDKVersion makes sure the device runs the SDK version used by jag.
+// Devices reject programs compiled with another version of the SDK, so
+// if the versions differ, we offer to update the firmware on the device
+// first. The update happens without asking if '--update-firmware' is
+// given. The returned device has a new ID if the firmware was updated.
+func checkSDKVersion(cmd *cobra.Command, cfg *viper.Viper, sdk *SDK, device *Device) (*Device, error) {
+	// The version stored at scan time is outdated if the firmware has been
+	// updated since, so we ask the device and remember its answer.
+	identity, err := device.Identify(cmd.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask '%s' for its SDK version: %w", device.Name, err)
+	}
+	if identity.SDKVersion != device.SDKVersion {
+		current := *device
+		current.SDKVersion = identity.SDKVersion
+		device = &current
+		if err := updateStoredDevice(cfg, device.ID, device); err != nil {
+			return nil, err
+		}
+	}
+
+	// Devices that don't report their version are left to the device to
+	// check.
+	if device.SDKVersion == "" || device.SDKVersion == sdk.Version {
+		return device, nil
+	}
+
+	fmt.Printf("Device '%s' runs Toit SDK %s, but jag uses Toit SDK %s.\n", device.Name, device.SDKVersion, sdk.Version)
+	fmt.Println("Code compiled with one SDK version can't run on a device with another, so the")
+	fmt.Println("firmware on the device must be updated first.")
+
+	mismatchErr := fmt.Errorf("SDK version mismatch, use 'jag firmware update -d %s' to update the device", device.Name)
+
+	update, err := cmd.Flags().GetBool("update-firmware")
+	if err != nil {
+		return nil, err
+	}
+	if !update {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, mismatchErr
+		}
+		fmt.Printf("Update the firmware on '%s' now? This uninstalls all containers [y/N]: ", device.Name)
+		answer, err := ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+			return nil, mismatchErr
+		}
+	}
+
+	// We can't ask for the WiFi settings in the middle of deploying
+	// without a terminal.
+	if !hasWifiConfig(cmd) && !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("the WiFi settings for the new firmware are unknown, use '--wifi-ssid' and '--wifi-password' or '--wifi-profile'")
+	}
+	wifi, err := getWifiConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := cmd.Context()
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listener, err := listenForIdentify(listenCtx, scanPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for devices: %w", err)
+	}
+
+	fmt.Printf("Updating firmware on '%s' to Toit SDK %s ...\n", device.Name, sdk.Version)
+	entry := &rolloutEntry{Name: device.Name, OldID: device.ID, device: device}
+	if err := updateAndVerify(ctx, sdk, wifi, listener, entry, firmwareVerifyTimeout); err != nil {
+		return nil, fmt.Errorf("failed to update the firmware on '%s': %w", device.Name, err)
+	}
+	fmt.Printf("Updated the firmware on '%s'\n\n", device.Name)
+
+	if err := updateStoredDevice(cfg, entry.OldID, entry.device); err != nil {
+		return nil, err
+	}
+	return entry.device, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// startIdentifyServer starts a device stand-in that identifies itself
+// with the given SDK version.
+func startIdentifyServer(t *testing.T, sdkVersion string) string {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/identify" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method": "jaguar.identify",
+			"payload": map[string]interface{}{
+				"name":       "test",
+				"id":         "device-id",
+				"sdkVersion": sdkVersion,
+			},
+		})
+	}))
+	t.Cleanup(device.Close)
+	return device.URL
+}
+
+func runCheckSDKVersion(cfg *viper.Viper, sdk *SDK, device *Device) (*Device, error) {
+	var res *Device
+	cmd := &cobra.Command{
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			res, err = checkSDKVersion(cmd, cfg, sdk, device)
+			return err
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	addUpdateFirmwareFlag(cmd)
+	cmd.SetArgs([]string{})
+	err := cmd.ExecuteContext(context.Background())
+	return res, err
+}
+
+func TestCheckSDKVersionAsksDevice(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	device := &Device{
+		ID:         "device-id",
+		Name:       "test",
+		Address:    startIdentifyServer(t, sdk.Version),
+		SDKVersion: "v1.0.0",
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := viper.New()
+	cfg.SetConfigFile(configPath)
+	cfg.Set("device", device)
+	if err := cfg.WriteConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The firmware was updated since the scan, so there's no mismatch.
+	checked, err := runCheckSDKVersion(cfg, sdk, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked.SDKVersion != sdk.Version {
+		t.Errorf("expected SDK version %s, got %s", sdk.Version, checked.SDKVersion)
+	}
+
+	stored := viper.New()
+	stored.SetConfigFile(configPath)
+	if err := stored.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var d Device
+	if err := stored.UnmarshalKey("device", &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.SDKVersion != sdk.Version {
+		t.Errorf("expected the stored SDK version to be %s, got %s", sdk.Version, d.SDKVersion)
+	}
+}
@@ -31,18 +31,6 @@ func getESP32ImageURL(version string) string {
 	return fmt.Sprintf("https://github.com/toitlang/jaguar/releases/download/%s/image.tar.gz", version)
 }
 
-func getEsptoolURL(version string) string {
-	currOS := runtime.GOOS
-	if currOS == "darwin" {
-		currOS = "macos"
-	}
-	return directory.Executable(fmt.Sprintf("https://github.com/toitlang/jaguar/releases/download/esptool-%s/esptool_%s_%s", version, currOS, version))
-}
-
-const (
-	esptoolVersion = "v3.0"
-)
-
 func SetupCmd(info Info) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "setup",
@@ -74,10 +62,6 @@ func SetupCmd(info Info) *cobra.Command {
 					return err
 				}
 
-				if _, err := directory.GetEsptoolPath(); err != nil {
-					return err
-				}
-
 				if err := copySnapshotsIntoCache(); err != nil {
 					return err
 				}
@@ -101,10 +85,6 @@ func SetupCmd(info Info) *cobra.Command {
 				return err
 			}
 
-			if err := downloadEsptool(ctx, esptoolVersion); err != nil {
-				return err
-			}
-
 			downloaderBytes, err := json.Marshal(&info)
 			if err != nil {
 				return err
@@ -230,33 +210,6 @@ func copySnapshotsIntoCache() error {
 	return nil
 }
 
-func downloadEsptool(ctx context.Context, version string) error {
-	esptoolPath, err := directory.GetEsptoolCachePath()
-	if err != nil {
-		return err
-	}
-
-	esptoolURL := getEsptoolURL(version)
-	fmt.Printf("Downloading esptool from %s ...\n", esptoolURL)
-	bundle, err := download(ctx, esptoolURL)
-	if err != nil {
-		return err
-	}
-	defer bundle.Close()
-
-	f, err := os.OpenFile(esptoolPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := io.Copy(f, bundle); err != nil {
-		return err
-	}
-	bundle.Close()
-	fmt.Println("Successfully installed esptool into", esptoolPath)
-	return nil
-}
-
 func downloadSDK(ctx context.Context, version string) error {
 	sdkPath, err := directory.GetSDKCachePath()
 	if err != nil {
@@ -0,0 +1,208 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// The simulator keeps the identity of the device in this file in its
+// state directory. The simulator itself writes the installed containers
+// next to it.
+const simulatorIdentityFile = "identity.json"
+
+// loadSimulatorIdentity returns the identity stored in the state
+// directory. A new identity is created the first time the directory is
+// used. If name is set, it replaces the stored name.
+func loadSimulatorIdentity(dir string, name string) (simulatorIdentity, error) {
+	var res simulatorIdentity
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return res, err
+	}
+
+	path := filepath.Join(dir, simulatorIdentityFile)
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(content, &res); err != nil {
+			return res, fmt.Errorf("failed to parse '%s': %w", path, err)
+		}
+		if _, err := uuid.Parse(res.ID); err != nil {
+			return res, fmt.Errorf("invalid id '%s' in '%s'", res.ID, path)
+		}
+	} else if !os.IsNotExist(err) {
+		return res, err
+	}
+
+	changed := false
+	if res.ID == "" {
+		id := uuid.New()
+		res.ID = id.String()
+		res.Name = GetRandomName(id[:])
+		changed = true
+	}
+	if name != "" && name != res.Name {
+		res.Name = name
+		changed = true
+	}
+	if !changed {
+		return res, nil
+	}
+
+	content, err = json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+	return res, os.WriteFile(path, content, 0644)
+}
+
+// snapshotSimulatorState writes the content of the state directory to a
+// .tar.gz archive.
+func snapshotSimulatorState(dir string, archive string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no simulator state in '%s': %w", dir, err)
+	}
+
+	file, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// restoreSimulatorState replaces the content of the state directory with
+// the content of an archive written by snapshotSimulatorState.
+func restoreSimulatorState(dir string, archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a simulator snapshot: %w", archive, err)
+	}
+	defer gz.Close()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %w", archive, err)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path '%s' in '%s'", header.Name, archive)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func SimulateSnapshotCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot <file>",
+		Short: "Save the state of simulated devices to a file",
+		Long: "Save the identities and installed containers of the simulated devices that\n" +
+			"use a state directory to a .tar.gz file. Use 'jag simulate --restore <file>'\n" +
+			"to go back to the saved state. The simulators should be stopped while\n" +
+			"taking the snapshot.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := cmd.Flags().GetString("state-dir")
+			if err != nil {
+				return err
+			}
+			if err := snapshotSimulatorState(stateDir, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Saved the simulator state in '%s' to '%s'\n", stateDir, args[0])
+			return nil
+		},
+	}
+
+	cmd.Flags().String("state-dir", "", "the state directory of the simulators")
+	cmd.MarkFlagRequired("state-dir")
+	return cmd
+}
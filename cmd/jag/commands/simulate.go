@@ -6,21 +6,56 @@ package commands
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
 
+const (
+	// The identities of the simulators started with 'jag simulate --count'.
+	SimulatorsCfgKey = "simulators"
+)
+
+type simulatorIdentity struct {
+	ID   string `mapstructure:"id" yaml:"id" json:"id"`
+	Name string `mapstructure:"name" yaml:"name" json:"name"`
+}
+
+type simulator struct {
+	simulatorIdentity
+	port uint
+	// If set, the output of the simulator gets this prefix.
+	prefix string
+	// If set, the simulator keeps its state in this directory.
+	stateDir string
+}
+
 func SimulateCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "simulate",
 		Short: "Start a simulated Jaguar device on your machine",
 		Long: "Start a simulated Jaguar device on your host machine. Useful for testing\n" +
-			"and for experimenting with the Jaguar-based workflows.",
+			"and for experimenting with the Jaguar-based workflows.\n\n" +
+			"With '--count' several simulated devices are started at once. They keep\n" +
+			"their ids and names across restarts, and their output is prefixed with\n" +
+			"their names.\n\n" +
+			"With '--state-dir' the simulated devices keep their ids, names and installed\n" +
+			"containers in a directory, so the containers are still there when the\n" +
+			"simulators are started again. Use '--reset' to start over and 'jag simulate\n" +
+			"snapshot' to save the state for later use with '--restore'.\n\n" +
+			"With '--latency', '--loss', '--bandwidth' and '--cut-after' the simulated\n" +
+			"devices are reached over a simulated bad network. See 'jag netem' for\n" +
+			"reaching a physical device the same way.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -30,15 +65,110 @@ func SimulateCmd() *cobra.Command {
 				return err
 			}
 
-			id := uuid.New()
-			var name string
-			if cmd.Flags().Changed("name") {
-				name, err = cmd.Flags().GetString("name")
-				if err != nil {
+			name, err := cmd.Flags().GetString("name")
+			if err != nil {
+				return err
+			}
+
+			count, err := cmd.Flags().GetInt("count")
+			if err != nil {
+				return err
+			}
+			if count < 1 {
+				return fmt.Errorf("--count must be at least 1")
+			}
+
+			stateDir, err := cmd.Flags().GetString("state-dir")
+			if err != nil {
+				return err
+			}
+
+			reset, err := cmd.Flags().GetBool("reset")
+			if err != nil {
+				return err
+			}
+
+			restore, err := cmd.Flags().GetString("restore")
+			if err != nil {
+				return err
+			}
+
+			if stateDir == "" && (reset || restore != "") {
+				return fmt.Errorf("--reset and --restore can only be used with --state-dir")
+			}
+			if reset && restore != "" {
+				return fmt.Errorf("give either --reset or --restore, not both")
+			}
+
+			netem, err := parseNetemFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if reset {
+				if err := os.RemoveAll(stateDir); err != nil {
 					return err
 				}
+			}
+			if restore != "" {
+				if err := restoreSimulatorState(stateDir, restore); err != nil {
+					return err
+				}
+			}
+
+			var simulators []*simulator
+			if stateDir != "" {
+				for i := 0; i < count; i++ {
+					s := &simulator{
+						stateDir: stateDir,
+						port:     port,
+					}
+					simName := name
+					if cmd.Flags().Changed("count") {
+						// Every simulator has its own directory.
+						s.stateDir = filepath.Join(stateDir, strconv.Itoa(i+1))
+						if name != "" {
+							simName = fmt.Sprintf("%s-%d", name, i+1)
+						}
+						if port != 0 {
+							s.port = port + uint(i)
+						}
+					}
+					if s.simulatorIdentity, err = loadSimulatorIdentity(s.stateDir, simName); err != nil {
+						return err
+					}
+					if cmd.Flags().Changed("count") {
+						s.prefix = "[" + s.Name + "] "
+					}
+					simulators = append(simulators, s)
+				}
+			} else if !cmd.Flags().Changed("count") {
+				id := uuid.New()
+				if name == "" {
+					name = GetRandomName(id[:])
+				}
+				simulators = append(simulators, &simulator{
+					simulatorIdentity: simulatorIdentity{ID: id.String(), Name: name},
+					port:              port,
+				})
 			} else {
-				name = GetRandomName(id[:])
+				identities, err := simulatorIdentities(count)
+				if err != nil {
+					return err
+				}
+				for i, identity := range identities {
+					if name != "" {
+						identity.Name = fmt.Sprintf("%s-%d", name, i+1)
+					}
+					s := &simulator{
+						simulatorIdentity: identity,
+						prefix:            "[" + identity.Name + "] ",
+					}
+					// Port 0 lets every simulator pick a free port.
+					if port != 0 {
+						s.port = port + uint(i)
+					}
+					simulators = append(simulators, s)
+				}
 			}
 
 			sdk, err := GetSDK(ctx)
@@ -51,27 +181,175 @@ func SimulateCmd() *cobra.Command {
 				return err
 			}
 
-			outReader, outWriter := io.Pipe()
+			output, err := parseLogOutputFlags(cmd)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
 
-			// Goroutine that gets data from the pipe and converts it into
-			// lines.
+			// Stop all the simulators on Ctrl-C and wait for them to
+			// exit, so none of them are left behind.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			defer signal.Stop(interrupt)
 			go func() {
-				scanner := bufio.NewScanner(outReader)
+				select {
+				case <-interrupt:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
 
-				decoder := Decoder{scanner, cmd}
+			if len(simulators) > 1 {
+				fmt.Printf("Starting %d simulators\n", len(simulators))
+			}
+			if netem.enabled() {
+				fmt.Printf("Simulating a network with %s\n", netem)
+			}
 
-				decoder.decode()
-			}()
+			var wg sync.WaitGroup
+			errs := make([]error, len(simulators))
+			for i, s := range simulators {
+				wg.Add(1)
+				go func(i int, s *simulator) {
+					defer wg.Done()
+					errs[i] = runSimulator(ctx, cmd, sdk, output, snapshot, s, netem)
+				}(i, s)
+			}
+			wg.Wait()
 
-			simCmd := sdk.ToitRun(ctx, snapshot, strconv.Itoa(int(port)), id.String(), name)
-			simCmd.Stderr = os.Stderr
-			simCmd.Stdout = outWriter
-			return simCmd.Run()
+			if ctx.Err() != nil {
+				// Stopped on purpose.
+				return nil
+			}
+			for _, err := range errs {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		},
 	}
 
-	cmd.Flags().UintP("port", "p", 0, "port to run the simulator on")
+	cmd.Flags().UintP("port", "p", 0, "port to run the simulator on (with '--count', the first of consecutive ports)")
 	cmd.Flags().String("name", "", "name for the simulator, if not set a name will be auto generated")
+	cmd.Flags().Int("count", 1, "number of simulators to start")
+	cmd.Flags().String("state-dir", "", "keep the identity and the installed containers of the simulators in this directory")
+	cmd.Flags().Bool("reset", false, "clear the state directory before starting")
+	cmd.Flags().String("restore", "", "restore the state directory from a snapshot before starting")
+	cmd.AddCommand(SimulateSnapshotCmd())
+	addLogOutputFlags(cmd)
+	addNetemFlags(cmd)
 
 	return cmd
 }
+
+func runSimulator(ctx context.Context, cmd *cobra.Command, sdk *SDK, output *logOutput, snapshot string, s *simulator, netem netemConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// With an impaired network, the simulator runs on a private port and
+	// announces the port of a proxy in front of it instead.
+	simPort := s.port
+	advertisedPort := ""
+	if netem.enabled() {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+		if err != nil {
+			return err
+		}
+		if simPort, err = freePort(); err != nil {
+			listener.Close()
+			return err
+		}
+		advertisedPort = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		target := fmt.Sprintf("http://127.0.0.1:%d", simPort)
+		go func() {
+			if err := serveNetemProxy(ctx, listener, target, netem); err != nil {
+				fmt.Fprintf(os.Stderr, "Network proxy for '%s' stopped: %v\n", s.Name, err)
+			}
+		}()
+	}
+
+	outReader, outWriter := io.Pipe()
+
+	// Goroutine that gets data from the pipe and converts it into
+	// lines.
+	decoded := make(chan struct{})
+	go func() {
+		defer close(decoded)
+		scanner := bufio.NewScanner(outReader)
+
+		decoder := output.newDecoder(scanner, cmd, s.Name, s.prefix)
+
+		decoder.decode()
+	}()
+
+	args := []string{snapshot, strconv.Itoa(int(simPort)), s.ID, s.Name}
+	if s.stateDir != "" || advertisedPort != "" {
+		args = append(args, s.stateDir)
+	}
+	if advertisedPort != "" {
+		args = append(args, advertisedPort)
+	}
+	simCmd := sdk.ToitRun(ctx, args...)
+	simCmd.Stdout = outWriter
+	simCmd.Stderr = os.Stderr
+	if s.prefix != "" {
+		simCmd.Stderr = outWriter
+	}
+	err := simCmd.Run()
+	outWriter.Close()
+	<-decoded
+	if err != nil && ctx.Err() == nil {
+		if s.prefix != "" {
+			return fmt.Errorf("simulator '%s' stopped: %w", s.Name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// freePort returns a port that is currently not in use.
+func freePort() (uint, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return uint(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+// simulatorIdentities returns the ids and names of the first count
+// simulators. They are stored in the user config, so the simulators keep
+// them across restarts.
+func simulatorIdentities(count int) ([]simulatorIdentity, error) {
+	cfg, err := directory.GetUserConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []simulatorIdentity
+	if cfg.IsSet(SimulatorsCfgKey) {
+		if err := cfg.UnmarshalKey(SimulatorsCfgKey, &res); err != nil {
+			return nil, fmt.Errorf("failed to parse the simulators in the config: %w", err)
+		}
+	}
+	if len(res) >= count {
+		return res[:count], nil
+	}
+
+	for len(res) < count {
+		id := uuid.New()
+		res = append(res, simulatorIdentity{
+			ID:   id.String(),
+			Name: GetRandomName(id[:]),
+		})
+	}
+	cfg.Set(SimulatorsCfgKey, res)
+	if err := directory.WriteConfig(cfg); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
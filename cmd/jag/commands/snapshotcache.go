@@ -0,0 +1,175 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// compiledEntry remembers which snapshot a Toit file was last compiled
+// to, and the files it depended on at that time. If none of them have
+// changed, the snapshot can be used again without compiling.
+type compiledEntry struct {
+	Entrypoint   string   `json:"entrypoint"`
+	Dependencies []string `json:"dependencies"`
+	Key          string   `json:"key"`
+	Snapshot     string   `json:"snapshot"`
+}
+
+// compiledEntryPath returns the path of the entry for the Toit file at
+// path. The entries are kept next to the snapshots in the cache.
+func compiledEntryPath(snapshotsCache string, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(snapshotsCache, "compiled", hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// compiledKey hashes the content of the dependencies together with
+// everything else that goes into running the program.
+func compiledKey(sdk *SDK, defines string, dependencies []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "sdk:%s\x00defines:%s\x00", sdk.Version, defines)
+	for _, dependency := range dependencies {
+		file, err := os.Open(dependency)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", dependency)
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compiledDependencies returns the sorted dependencies listed in a
+// dependency file written by the compiler. The package files of the
+// project are added, because they decide where the imported packages
+// come from.
+func compiledDependencies(dependencyFile string, entrypoint string) ([]string, error) {
+	b, err := os.ReadFile(dependencyFile)
+	if err != nil {
+		return nil, err
+	}
+	res := parseDependeniesToDirs(b)
+	for dir := filepath.Dir(entrypoint); ; dir = filepath.Dir(dir) {
+		found := false
+		for _, name := range []string{"package.yaml", "package.lock"} {
+			p := filepath.Join(dir, name)
+			if _, err := os.Stat(p); err == nil {
+				res = append(res, p)
+				found = true
+			}
+		}
+		if found || filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	for i, p := range res {
+		if abs, err := filepath.Abs(p); err == nil {
+			res[i] = abs
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// lookupCompiled returns the cached snapshot for the Toit file at path
+// and the files it depends on, if it was compiled before and none of its
+// dependencies have changed.
+func lookupCompiled(sdk *SDK, snapshotsCache string, path string, defines string) (string, []string, bool) {
+	entryPath, err := compiledEntryPath(snapshotsCache, path)
+	if err != nil {
+		return "", nil, false
+	}
+	b, err := os.ReadFile(entryPath)
+	if err != nil {
+		return "", nil, false
+	}
+	var entry compiledEntry
+	if err := json.Unmarshal(b, &entry); err != nil || len(entry.Dependencies) == 0 {
+		return "", nil, false
+	}
+	key, err := compiledKey(sdk, defines, entry.Dependencies)
+	if err != nil || key != entry.Key {
+		return "", nil, false
+	}
+	snapshot := filepath.Join(snapshotsCache, entry.Snapshot)
+	if _, err := os.Stat(snapshot); err != nil {
+		return "", nil, false
+	}
+	return snapshot, entry.Dependencies, true
+}
+
+// storeCompiled remembers that the Toit file at path was compiled to the
+// snapshot in the cache. The compilation started at the given time.
+func storeCompiled(sdk *SDK, snapshotsCache string, path string, defines string, dependencies []string, snapshot string, started time.Time) error {
+	entryPath, err := compiledEntryPath(snapshotsCache, path)
+	if err != nil {
+		return err
+	}
+	// If a dependency changed while we were compiling, the snapshot may
+	// have the old content, so we can't use it again. The modification
+	// times can be rather coarse, so we stay on the safe side.
+	for _, dependency := range dependencies {
+		stat, err := os.Stat(dependency)
+		if err != nil {
+			return err
+		}
+		if !stat.ModTime().Before(started.Add(-time.Second)) {
+			return nil
+		}
+	}
+	key, err := compiledKey(sdk, defines, dependencies)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(compiledEntry{
+		Entrypoint:   abs,
+		Dependencies: dependencies,
+		Key:          key,
+		Snapshot:     filepath.Base(snapshot),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0755); err != nil {
+		return err
+	}
+	// Write the entry atomically, so concurrent runs never see half of it.
+	// Every run writes its own temporary file, so they don't get in each
+	// other's way.
+	tmp, err := os.CreateTemp(filepath.Dir(entryPath), "*.json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), entryPath)
+}
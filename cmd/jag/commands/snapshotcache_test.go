@@ -0,0 +1,175 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testProject struct {
+	cache        string
+	entrypoint   string
+	snapshot     string
+	dependencies []string
+	started      time.Time
+}
+
+// newTestProject creates a program with a library and a snapshot for it
+// in a cache. The files are older than the start of the compilation.
+func newTestProject(t *testing.T) *testProject {
+	dir := t.TempDir()
+	cache := t.TempDir()
+	entrypoint := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	snapshot := filepath.Join(cache, "1234.snapshot")
+	writeTestFile(t, entrypoint, "import .lib\nmain: foo\n")
+	writeTestFile(t, lib, "foo: print 42\n")
+	writeTestFile(t, snapshot, "snapshot")
+
+	old := time.Now().Add(-time.Hour)
+	for _, p := range []string{entrypoint, lib} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testProject{
+		cache:        cache,
+		entrypoint:   entrypoint,
+		snapshot:     snapshot,
+		dependencies: []string{lib, entrypoint},
+		started:      time.Now(),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testProject) store(t *testing.T, sdk *SDK, defines string) {
+	if err := storeCompiled(sdk, p.cache, p.entrypoint, defines, p.dependencies, p.snapshot, p.started); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompiledCacheHit(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	p := newTestProject(t)
+	if _, _, ok := lookupCompiled(sdk, p.cache, p.entrypoint, ""); ok {
+		t.Fatal("found a snapshot before storing one")
+	}
+	p.store(t, sdk, `{"a":"1"}`)
+
+	snapshot, dependencies, ok := lookupCompiled(sdk, p.cache, p.entrypoint, `{"a":"1"}`)
+	if !ok {
+		t.Fatal("the snapshot was not found")
+	}
+	if snapshot != p.snapshot {
+		t.Errorf("got snapshot '%s', expected '%s'", snapshot, p.snapshot)
+	}
+	if !reflect.DeepEqual(dependencies, p.dependencies) {
+		t.Errorf("got dependencies %v, expected %v", dependencies, p.dependencies)
+	}
+}
+
+func TestCompiledCacheMiss(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	tests := []struct {
+		name    string
+		change  func(t *testing.T, p *testProject)
+		sdk     *SDK
+		defines string
+	}{
+		{"changed dependency", func(t *testing.T, p *testProject) {
+			writeTestFile(t, p.dependencies[0], "foo: print 43\n")
+		}, sdk, ""},
+		{"removed dependency", func(t *testing.T, p *testProject) {
+			os.Remove(p.dependencies[0])
+		}, sdk, ""},
+		{"removed snapshot", func(t *testing.T, p *testProject) {
+			os.Remove(p.snapshot)
+		}, sdk, ""},
+		{"other defines", nil, sdk, `{"a":"2"}`},
+		{"other SDK", nil, &SDK{Version: "v2.0.1"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProject(t)
+			p.store(t, sdk, "")
+			if test.change != nil {
+				test.change(t, p)
+			}
+			if _, _, ok := lookupCompiled(test.sdk, p.cache, p.entrypoint, test.defines); ok {
+				t.Error("found the old snapshot")
+			}
+		})
+	}
+}
+
+func TestCompiledChangedWhileCompiling(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	p := newTestProject(t)
+	// The library is saved after the compilation started.
+	p.started = time.Now().Add(-time.Minute)
+	writeTestFile(t, p.dependencies[0], "foo: print 43\n")
+	p.store(t, sdk, "")
+	if _, _, ok := lookupCompiled(sdk, p.cache, p.entrypoint, ""); ok {
+		t.Error("remembered a snapshot that may have the old content")
+	}
+}
+
+func TestCompiledConcurrentStores(t *testing.T) {
+	sdk := &SDK{Version: "v2.0.0"}
+	p := newTestProject(t)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storeCompiled(sdk, p.cache, p.entrypoint, "", p.dependencies, p.snapshot, p.started)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok := lookupCompiled(sdk, p.cache, p.entrypoint, ""); !ok {
+		t.Error("the snapshot was not found")
+	}
+	entries, err := os.ReadDir(filepath.Join(p.cache, "compiled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected a single entry in the cache, found %d files", len(entries))
+	}
+}
+
+func TestCompiledDependencies(t *testing.T) {
+	p := newTestProject(t)
+	dir := filepath.Dir(p.entrypoint)
+	packageFile := filepath.Join(dir, "package.yaml")
+	writeTestFile(t, packageFile, "dependencies:\n")
+	dependencyFile := filepath.Join(t.TempDir(), "dependencies.txt")
+	writeTestFile(t, dependencyFile, p.entrypoint+":\n"+p.dependencies[0]+"\n"+filepath.Join(dir, "missing.toit")+"\n")
+
+	dependencies, err := compiledDependencies(dependencyFile, p.entrypoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{p.dependencies[0], p.entrypoint, packageFile}
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("got dependencies %v, expected %v", dependencies, expected)
+	}
+}
@@ -191,6 +191,13 @@ func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string) e
 	return nil
 }
 
+// CompileWithDiagnostics is like Compile, but it returns the diagnostics
+// printed by the compiler instead of printing them. The files the
+// entrypoint depends on are written to dependencyFile.
+func (s *SDK) CompileWithDiagnostics(ctx context.Context, snapshot string, entrypoint string, dependencyFile string) ([]byte, error) {
+	return s.ToitCompile(ctx, "--dependency-file", dependencyFile, "--dependency-format", "plain", "-w", snapshot, entrypoint).CombinedOutput()
+}
+
 func (s *SDK) Build(ctx context.Context, device *Device, snapshot string) ([]byte, error) {
 	image, err := os.CreateTemp("", "*.image")
 	if err != nil {
@@ -415,6 +422,23 @@ func parseDeviceFlag(cmd *cobra.Command) (deviceSelect, error) {
 	return parseDeviceSelection(d), nil
 }
 
+func parseDevicesFlag(cmd *cobra.Command) ([]deviceSelect, error) {
+	if !cmd.Flags().Changed("device") {
+		return nil, nil
+	}
+
+	ds, err := cmd.Flags().GetStringArray("device")
+	if err != nil {
+		return nil, err
+	}
+
+	var res []deviceSelect
+	for _, d := range ds {
+		res = append(res, parseDeviceSelection(d))
+	}
+	return res, nil
+}
+
 func parseDeviceSelection(d string) deviceSelect {
 	if _, err := uuid.Parse(d); err == nil {
 		return deviceIDSelect(d)
@@ -422,9 +446,20 @@ func parseDeviceSelection(d string) deviceSelect {
 	if ip := net.ParseIP(d); ip != nil {
 		return deviceAddressSelect(d)
 	}
+	// Also accept an address with a port, like the address of a proxy.
+	if host, _, err := net.SplitHostPort(d); err == nil && net.ParseIP(host) != nil {
+		return deviceAddressSelect(d)
+	}
 	return deviceNameSelect(d)
 }
 
+// isHostSelect returns whether the device selection is the special 'host'
+// device, which means running on this computer.
+func isHostSelect(d deviceSelect) bool {
+	name, ok := d.(deviceNameSelect)
+	return ok && string(name) == "host"
+}
+
 type shortEncoder struct {
 	w io.Writer
 }
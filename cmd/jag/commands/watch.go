@@ -9,7 +9,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,8 +23,14 @@ import (
 
 func WatchCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "watch <file>",
-		Short:        "Watch for changes to <file> and its dependencies and automatically re-run the code",
+		Use:   "watch <file>",
+		Short: "Watch for changes to <file> and its dependencies and automatically re-run the code",
+		Long: "Watch for changes to <file> and its dependencies and automatically re-run the\n" +
+			"code on the device. Use '-d' more than once to run the code on several devices\n" +
+			"at once, and '--install <name>' to install the code as a named container\n" +
+			"instead of running it.\n\n" +
+			"With '-d host' the code runs on this computer instead. It is stopped and\n" +
+			"started again on every change.",
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -44,44 +50,123 @@ func WatchCmd() *cobra.Command {
 			}
 
 			ctx := cmd.Context()
-			deviceSelect, err := parseDeviceFlag(cmd)
+			deviceSelects, err := parseDevicesFlag(cmd)
 			if err != nil {
 				return err
 			}
 
-			sdk, err := GetSDK(ctx)
-			if err != nil {
+			var opts watchOptions
+			var selects []deviceSelect
+			for _, ds := range deviceSelects {
+				if isHostSelect(ds) {
+					opts.host = true
+				} else {
+					selects = append(selects, ds)
+				}
+			}
+			if opts.install, err = cmd.Flags().GetString("install"); err != nil {
 				return err
 			}
+			if cmd.Flags().Changed("install") && opts.install == "" {
+				return fmt.Errorf("--install needs the name of the container")
+			}
 
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if opts.defines, err = parseDefineFlags(cmd, "define"); err != nil {
+				return err
+			}
+
+			if opts.debounce, err = cmd.Flags().GetDuration("debounce"); err != nil {
+				return err
+			}
+			if opts.debounce <= 0 {
+				return fmt.Errorf("--debounce must be positive")
+			}
+
+			if opts.host && opts.defines != "" {
+				return fmt.Errorf("--define/-D is not yet supported when running on host")
+			}
+			if opts.host && opts.install != "" {
+				return fmt.Errorf("--install is not supported when running on host")
+			}
+
+			if _, err := diagnosticsFormat(cmd); err != nil {
+				return err
+			}
+
+			if opts.output, err = parseLogOutputFlags(cmd); err != nil {
+				return err
+			}
+			defer opts.output.Close()
+
+			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
 			}
 
+			if !opts.host || len(selects) > 0 {
+				devices, err := GetDevices(ctx, cfg, sdk, true, selects)
+				if err != nil {
+					return err
+				}
+
+				for i, device := range devices {
+					if devices[i], err = checkSDKVersion(cmd, cfg, sdk, device); err != nil {
+						return err
+					}
+				}
+				opts.devices = devices
+			}
+
 			watcher, err := newWatcher()
 			if err != nil {
 				return err
 			}
 			defer watcher.Close()
 
-			waitCh, fn := onWatchChanges(cmd, watcher, device, sdk, entrypoint)
+			waitCh, fn := onWatchChanges(cmd, watcher, sdk, entrypoint, opts)
 			go fn()
 
 			<-waitCh
 			return nil
 		},
 	}
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().StringArrayP("device", "d", nil, "use device with a given name, id, or address (can be repeated)")
+	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
+	cmd.Flags().String("install", "", "install the code as a container with this name instead of running it")
+	cmd.Flags().Duration("debounce", 100*time.Millisecond, "wait this long for more changes before running the code again")
+	addUpdateFirmwareFlag(cmd)
+	addLogOutputFlags(cmd)
+	addDiagnosticsFlag(cmd)
 
 	return cmd
 }
 
+// watchOptions says what 'jag watch' does with the code when it changes.
+type watchOptions struct {
+	devices []*Device
+	// If set, the code also runs on this computer.
+	host bool
+	// Where the output of the code running on this computer goes.
+	output *logOutput
+	// If set, the code is installed as a container with this name
+	// instead of being run.
+	install  string
+	defines  string
+	debounce time.Duration
+}
+
+// watcher watches the directories of the dependencies instead of the
+// dependencies themselves. Many editors save a file by writing a new file
+// and renaming it over the old one, and a watch on the old file is lost
+// when that happens.
 type watcher struct {
 	sync.Mutex
 	watcher *fsnotify.Watcher
 
-	paths map[string]struct{}
+	// The watched directories.
+	dirs map[string]struct{}
+	// The files we care about in the watched directories.
+	files map[string]struct{}
 }
 
 func newWatcher() (*watcher, error) {
@@ -91,7 +176,8 @@ func newWatcher() (*watcher, error) {
 	}
 	return &watcher{
 		watcher: w,
-		paths:   map[string]struct{}{},
+		dirs:    map[string]struct{}{},
+		files:   map[string]struct{}{},
 	}, nil
 }
 
@@ -108,38 +194,119 @@ func (w *watcher) Errors() chan error {
 }
 
 func (w *watcher) CountPaths() int {
-	return len(w.paths)
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return len(w.files)
 }
 
-func (w *watcher) Watch(paths ...string) (err error) {
-	for i, p := range paths {
-		if paths[i], err = filepath.EvalSymlinks(p); err != nil {
-			return err
-		}
+// resolvePath returns the path with the symbolic links in its directory
+// resolved, which is how the events for it are named. The file itself
+// may be missing while an editor is replacing it.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
 
-	candidates := map[string]struct{}{}
+// Watch changes the watched files to the given paths. A path can also be
+// a directory, in which case all changes in it are of interest.
+func (w *watcher) Watch(paths ...string) error {
+	files := map[string]struct{}{}
+	dirs := map[string]struct{}{}
 	for _, p := range paths {
-		if _, ok := w.paths[p]; !ok {
-			w.Mutex.Lock()
-			w.watcher.Add(p)
-			w.paths[p] = struct{}{}
-			w.Mutex.Unlock()
+		if stat, err := os.Stat(p); err == nil && stat.IsDir() {
+			dir, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return err
+			}
+			dirs[dir] = struct{}{}
+			continue
+		}
+		resolved, err := resolvePath(p)
+		if err != nil {
+			return err
+		}
+		files[resolved] = struct{}{}
+		dirs[filepath.Dir(resolved)] = struct{}{}
+		// If the file is a symbolic link, the changes happen to the file
+		// it links to.
+		if target, err := filepath.EvalSymlinks(resolved); err == nil && target != resolved {
+			files[target] = struct{}{}
+			dirs[filepath.Dir(target)] = struct{}{}
 		}
-		candidates[p] = struct{}{}
 	}
 
-	for p := range w.paths {
-		if _, ok := candidates[p]; !ok {
-			w.Mutex.Lock()
-			w.watcher.Remove(p)
-			delete(w.paths, p)
-			w.Mutex.Unlock()
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for dir := range dirs {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			return err
+		}
+		w.dirs[dir] = struct{}{}
+	}
+	for dir := range w.dirs {
+		if _, ok := dirs[dir]; !ok {
+			w.watcher.Remove(dir)
+			delete(w.dirs, dir)
 		}
 	}
+	w.files = files
 	return nil
 }
 
+// Relevant returns whether the event changes the program. Besides the
+// changes to the dependencies, new Toit files are of interest, because
+// they may be the missing imports of a program that didn't compile.
+func (w *watcher) Relevant(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if _, ok := w.dirs[name]; ok && event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+		// The watched directory itself was replaced. The watch on it is
+		// gone, so we forget about it and add it again when updating the
+		// watcher.
+		delete(w.dirs, name)
+		w.watcher.Remove(name)
+		return true
+	}
+	if _, ok := w.files[name]; ok {
+		return true
+	}
+	if _, ok := w.dirs[filepath.Dir(name)]; !ok {
+		return false
+	}
+	if len(w.files) == 0 {
+		// We are watching whole directories.
+		return true
+	}
+	return event.Op&fsnotify.Create != 0 && filepath.Ext(name) == ".toit"
+}
+
+func describeEvent(event fsnotify.Event) string {
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		return fmt.Sprintf("File created '%s'", event.Name)
+	case event.Op&fsnotify.Remove != 0:
+		return fmt.Sprintf("File removed '%s'", event.Name)
+	case event.Op&fsnotify.Rename != 0:
+		return fmt.Sprintf("File renamed '%s'", event.Name)
+	}
+	return fmt.Sprintf("File modified '%s'", event.Name)
+}
+
 func parseDependeniesToDirs(b []byte) []string {
 	m := map[string]struct{}{}
 	scanner := bufio.NewScanner(bytes.NewReader(b))
@@ -156,73 +323,131 @@ func parseDependeniesToDirs(b []byte) []string {
 	return res
 }
 
-func onWatchChanges(cmd *cobra.Command, watcher *watcher, device *Device, sdk *SDK, entrypoint string) (<-chan struct{}, func()) {
+func onWatchChanges(cmd *cobra.Command, watcher *watcher, sdk *SDK, entrypoint string, opts watchOptions) (<-chan struct{}, func()) {
 	doneCh := make(chan struct{})
 	ctx := cmd.Context()
 
-	updateWatcher := func(runCtx context.Context) {
-		var paths []string
-		if tmpFile, err := ioutil.TempFile("", "*.txt"); err == nil {
-			defer os.Remove(tmpFile.Name())
-			tmpFile.Close()
-			cmd := sdk.ToitCompile(ctx, "--dependency-file", tmpFile.Name(), "--dependency-format", "plain", "--analyze", entrypoint)
-			if err := cmd.Run(); err == nil {
-				if b, err := ioutil.ReadFile(tmpFile.Name()); err == nil {
-					paths = parseDependeniesToDirs(b)
-				}
-			} else {
-				// A compilation error happened, we let the watch paths be if there was some.
-				if watcher.CountPaths() > 0 {
-					return
-				}
+	// compile compiles the code and updates the watcher with the files it
+	// depends on. If the code has errors, they are printed and we keep
+	// watching the files we already watch.
+	compile := func() (string, bool) {
+		snapshot, paths, err := compileWithDependencies(cmd, sdk, entrypoint, opts.defines, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", false
 			}
+			fmt.Println("Error:", err)
 		}
 
-		if len(paths) == 0 {
-			paths = []string{filepath.Dir(entrypoint)}
+		// We keep watching the files we have, if the code didn't compile.
+		if len(paths) == 0 && (err == nil || watcher.CountPaths() == 0) {
+			paths = []string{entrypoint}
 		}
-
-		if err := watcher.Watch(paths...); err != nil {
-			fmt.Println("Failed to update watcher: ", err)
+		if len(paths) > 0 {
+			if err := watcher.Watch(paths...); err != nil {
+				fmt.Println("Failed to update watcher: ", err)
+			}
 		}
+		return snapshot, err == nil
 	}
 
-	runOnDevice := func(runCtx context.Context) {
-		if err := RunFile(cmd, device, sdk, entrypoint, ""); err != nil {
-			fmt.Println("Error:", err)
-			return
+	host := &hostProgram{}
+	// runOnDevices sends the compiled code to all the devices at the same
+	// time.
+	runOnDevices := func(runCtx context.Context, snapshot string) {
+		if opts.host {
+			prefix := ""
+			if len(opts.devices) > 0 {
+				prefix = "[host] "
+			}
+			if err := host.start(runCtx, cmd, sdk, opts.output, entrypoint, snapshot, prefix); err != nil {
+				fmt.Println("Error:", err)
+			}
 		}
+
+		var wg sync.WaitGroup
+		for _, device := range opts.devices {
+			wg.Add(1)
+			go func(device *Device) {
+				defer wg.Done()
+				var err error
+				if opts.install != "" {
+					err = InstallSnapshot(cmd, device, sdk, opts.install, entrypoint, snapshot, opts.defines)
+				} else {
+					err = RunSnapshot(cmd, device, sdk, entrypoint, snapshot, opts.defines)
+				}
+				if err != nil {
+					fmt.Println("Error:", err)
+				}
+			}(device)
+		}
+		wg.Wait()
 	}
 
-	firstCtx, previousCancel := context.WithCancel(ctx)
-	go updateWatcher(firstCtx)
-	runOnDevice(firstCtx)
+	// The code is checked and deployed by a single goroutine, so a slow
+	// upload never overlaps with the next one. While the code has errors,
+	// the last good program keeps running.
+	changed := make(chan struct{}, 1)
+	go func() {
+		previousCancel := func() {}
+		deployed := false
+		for {
+			if snapshot, ok := compile(); ok {
+				previousCancel()
+				var runCtx context.Context
+				runCtx, previousCancel = context.WithCancel(ctx)
+				runOnDevices(runCtx, snapshot)
+				deployed = true
+			} else if ctx.Err() == nil && deployed {
+				fmt.Println("Keeping the last good program until the errors are fixed")
+			} else if ctx.Err() == nil {
+				fmt.Println("Waiting for the errors to be fixed")
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				previousCancel()
+				return
+			}
+		}
+	}()
+
 	return doneCh, func() {
 		defer close(doneCh)
-		fired := false
-		ticketDuration := 100 * time.Millisecond
-		ticker := time.NewTicker(ticketDuration)
-		defer ticker.Stop()
+		// Editors often save a file in several steps, so we wait for the
+		// changes to settle before running the program again.
+		timer := time.NewTimer(opts.debounce)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		pending := map[string]struct{}{}
 		for {
 			select {
 			case event, ok := <-watcher.Events():
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					if !fired {
-						fmt.Printf("File modified '%s'\n", event.Name)
-						previousCancel()
-						var innerCtx context.Context
-						innerCtx, previousCancel = context.WithCancel(ctx)
-						go updateWatcher(innerCtx)
-						go runOnDevice(innerCtx)
-						fired = true
-						ticker.Reset(ticketDuration)
+				if !watcher.Relevant(event) {
+					continue
+				}
+				if _, ok := pending[event.Name]; !ok {
+					fmt.Println(describeEvent(event))
+					pending[event.Name] = struct{}{}
+				}
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
 					}
 				}
-			case <-ticker.C:
-				fired = false
+				timer.Reset(opts.debounce)
+			case <-timer.C:
+				pending = map[string]struct{}{}
+				select {
+				case changed <- struct{}{}:
+				default:
+					// A compile is already scheduled.
+				}
 			case err, ok := <-watcher.Errors():
 				if !ok {
 					return
@@ -234,3 +459,64 @@ func onWatchChanges(cmd *cobra.Command, watcher *watcher, device *Device, sdk *S
 		}
 	}
 }
+
+// hostProgram is the program 'jag watch -d host' runs on this computer.
+type hostProgram struct {
+	mutex sync.Mutex
+	// Closed when the running program has stopped.
+	done chan struct{}
+}
+
+// start runs the snapshot on this computer until ctx is done. The program
+// started before must have been told to stop by cancelling its context;
+// we wait for it to be gone before starting the new one.
+func (p *hostProgram) start(ctx context.Context, cmd *cobra.Command, sdk *SDK, output *logOutput, entrypoint string, snapshot string, prefix string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.done != nil {
+		<-p.done
+		p.done = nil
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	fmt.Printf("Running '%s' on host ...\n", entrypoint)
+	outReader, outWriter := io.Pipe()
+	program := sdk.ToitRun(ctx, snapshot)
+	program.Stdout = outWriter
+	program.Stderr = outWriter
+	if err := program.Start(); err != nil {
+		outWriter.Close()
+		return err
+	}
+
+	// The output goes through the decoder, so stack traces are decoded
+	// just like they are for devices.
+	decoded := make(chan struct{})
+	go func() {
+		defer close(decoded)
+		scanner := bufio.NewScanner(outReader)
+		decoder := output.newDecoder(scanner, cmd, "host", prefix)
+		decoder.decode()
+	}()
+
+	done := make(chan struct{})
+	p.done = done
+	go func() {
+		defer close(done)
+		err := program.Wait()
+		outWriter.Close()
+		<-decoded
+		if ctx.Err() != nil {
+			// Stopped because the code changed.
+			return
+		}
+		if err != nil {
+			fmt.Printf("Program '%s' on host failed: %v\n", entrypoint, err)
+		} else {
+			fmt.Printf("Program '%s' on host finished\n", entrypoint)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+const (
+	WifiProfilesCfgKey       = "profiles"
+	WifiDefaultProfileCfgKey = "default-profile"
+)
+
+type wifiNetwork struct {
+	SSID     string `mapstructure:"ssid" yaml:"ssid" json:"ssid"`
+	Password string `mapstructure:"password" yaml:"password" json:"password"`
+}
+
+// wifiConfig is the network configuration that is embedded in the
+// firmware. The networks are tried in order and the device gets its
+// address via DHCP.
+type wifiConfig struct {
+	Networks []wifiNetwork `mapstructure:"networks" yaml:"networks" json:"networks"`
+}
+
+func (c *wifiConfig) validate() error {
+	if len(c.Networks) == 0 {
+		return fmt.Errorf("no WiFi networks configured")
+	}
+	for _, n := range c.Networks {
+		if n.SSID == "" {
+			return fmt.Errorf("WiFi network without SSID")
+		}
+	}
+	return nil
+}
+
+// binaryNetworks returns the networks in the format used in the image
+// config.
+func (c *wifiConfig) binaryNetworks() []binaryWifiNetwork {
+	var networks []binaryWifiNetwork
+	for _, n := range c.Networks {
+		networks = append(networks, binaryWifiNetwork{SSID: n.SSID, Password: n.Password})
+	}
+	return networks
+}
+
+func getWifiProfiles() (map[string]wifiConfig, error) {
+	cfg, err := directory.GetUserConfig()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]wifiConfig{}
+	key := WifiCfgKey + "." + WifiProfilesCfgKey
+	if cfg.IsSet(key) {
+		if err := cfg.UnmarshalKey(key, &res); err != nil {
+			return nil, fmt.Errorf("failed to parse the WiFi profiles: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// getWifiProfile returns the profile with the given name. Like all keys
+// in the config, profile names are case-insensitive.
+func getWifiProfile(name string) (*wifiConfig, error) {
+	profiles, err := getWifiProfiles()
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no WiFi profile named '%s', use 'jag config wifi profile list' to see the profiles", name)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("the WiFi profile '%s' can't be used: %w", name, err)
+	}
+	return &profile, nil
+}
+
+// getWifiConfig resolves the network configuration for the firmware. A
+// profile given with '--wifi-profile' wins, then an SSID given through
+// the flags or the environment, then the default profile and finally the
+// stored or prompted for SSID and password.
+func getWifiConfig(cmd *cobra.Command) (*wifiConfig, error) {
+	if cmd.Flags().Changed("wifi-profile") {
+		name, err := cmd.Flags().GetString("wifi-profile")
+		if err != nil {
+			return nil, err
+		}
+		return getWifiProfile(name)
+	}
+
+	_, ssidFromEnv := os.LookupEnv(directory.WifiSSIDEnv)
+	if !cmd.Flags().Changed("wifi-ssid") && !ssidFromEnv {
+		cfg, err := directory.GetUserConfig()
+		if err != nil {
+			return nil, err
+		}
+		if name := cfg.GetString(WifiCfgKey + "." + WifiDefaultProfileCfgKey); name != "" {
+			return getWifiProfile(name)
+		}
+	}
+
+	ssid, password, err := getWifiCredentials(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &wifiConfig{Networks: []wifiNetwork{{SSID: ssid, Password: password}}}, nil
+}
+
+// hasWifiConfig reports whether getWifiConfig can resolve the network
+// configuration without asking for it.
+func hasWifiConfig(cmd *cobra.Command) bool {
+	if cmd.Flags().Changed("wifi-profile") {
+		return true
+	}
+	cfg, err := directory.GetUserConfig()
+	if err != nil {
+		return false
+	}
+	if cfg.GetString(WifiCfgKey+"."+WifiDefaultProfileCfgKey) != "" {
+		return true
+	}
+	_, ssidFromEnv := os.LookupEnv(directory.WifiSSIDEnv)
+	_, passwordFromEnv := os.LookupEnv(directory.WifiPasswordEnv)
+	hasSSID := cmd.Flags().Changed("wifi-ssid") || ssidFromEnv || cfg.IsSet(WifiCfgKey+"."+WifiSSIDCfgKey)
+	hasPassword := cmd.Flags().Changed("wifi-password") || passwordFromEnv || cfg.IsSet(WifiCfgKey+"."+WifiPasswordCfgKey)
+	return hasSSID && hasPassword
+}
+
+func addWifiFlags(cmd *cobra.Command) {
+	cmd.Flags().String("wifi-ssid", "", "default WiFi SSID")
+	cmd.Flags().String("wifi-password", "", "default WiFi password")
+	cmd.Flags().String("wifi-profile", "", "use the WiFi networks of a profile (see 'jag config wifi profile')")
+}
+
+func ConfigWifiProfileCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Manage named WiFi profiles with several networks",
+		Long: "Manage named WiFi profiles. A profile has an ordered list of WiFi networks\n" +
+			"that devices try one after the other. The devices get their address via\n" +
+			"DHCP. Use a profile with '--wifi-profile' when flashing or updating the\n" +
+			"firmware, or make it the default with 'jag config wifi profile default'.",
+		Args: cobra.NoArgs,
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Create or replace a WiFi profile",
+		Long: "Create or replace a WiFi profile. Give '--wifi-ssid' and '--wifi-password'\n" +
+			"once for each network, in the order the device should try them.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if strings.Contains(args[0], ".") {
+				return fmt.Errorf("profile names cannot contain '.'")
+			}
+
+			ssids, err := cmd.Flags().GetStringArray("wifi-ssid")
+			if err != nil {
+				return err
+			}
+			passwords, err := cmd.Flags().GetStringArray("wifi-password")
+			if err != nil {
+				return err
+			}
+			if len(passwords) != len(ssids) {
+				return fmt.Errorf("give a --wifi-password for each --wifi-ssid (use \"\" for open networks)")
+			}
+
+			profile := wifiConfig{}
+			for i, ssid := range ssids {
+				profile.Networks = append(profile.Networks, wifiNetwork{SSID: ssid, Password: passwords[i]})
+			}
+			if err := profile.validate(); err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			cfg.Set(WifiCfgKey+"."+WifiProfilesCfgKey+"."+strings.ToLower(args[0]), profile)
+			return directory.WriteConfig(cfg)
+		},
+	}
+	setCmd.Flags().StringArray("wifi-ssid", nil, "SSID of a WiFi network (can be repeated)")
+	setCmd.Flags().StringArray("wifi-password", nil, "password of the WiFi network with the same position (can be repeated)")
+	setCmd.MarkFlagRequired("wifi-ssid")
+
+	listCmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the WiFi profiles",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profiles, err := getWifiProfiles()
+			if err != nil {
+				return err
+			}
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			defaultProfile := cfg.GetString(WifiCfgKey + "." + WifiDefaultProfileCfgKey)
+
+			var names []string
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				profile := profiles[name]
+				suffix := ""
+				if name == defaultProfile {
+					suffix = " (default)"
+				}
+				fmt.Printf("%s%s\n", name, suffix)
+				for _, n := range profile.Networks {
+					fmt.Printf("  network: %s\n", n.SSID)
+				}
+				if err := profile.validate(); err != nil {
+					fmt.Printf("  unusable: %v\n", err)
+				}
+			}
+			return nil
+		},
+	}
+
+	removeCmd := &cobra.Command{
+		Use:          "remove <name>",
+		Short:        "Remove a WiFi profile",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := getWifiProfile(args[0]); err != nil {
+				return err
+			}
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			name := strings.ToLower(args[0])
+			delete(cfg.Get(WifiCfgKey+"."+WifiProfilesCfgKey).(map[string]interface{}), name)
+			if strings.ToLower(cfg.GetString(WifiCfgKey+"."+WifiDefaultProfileCfgKey)) == name {
+				delete(cfg.Get(WifiCfgKey).(map[string]interface{}), WifiDefaultProfileCfgKey)
+			}
+			return directory.WriteConfig(cfg)
+		},
+	}
+
+	defaultCmd := &cobra.Command{
+		Use:          "default [<name>]",
+		Short:        "Use a WiFi profile unless another one is given, or stop using a default profile",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				if cfg.IsSet(WifiCfgKey + "." + WifiDefaultProfileCfgKey) {
+					delete(cfg.Get(WifiCfgKey).(map[string]interface{}), WifiDefaultProfileCfgKey)
+				}
+				return directory.WriteConfig(cfg)
+			}
+			if _, err := getWifiProfile(args[0]); err != nil {
+				return err
+			}
+			cfg.Set(WifiCfgKey+"."+WifiDefaultProfileCfgKey, strings.ToLower(args[0]))
+			return directory.WriteConfig(cfg)
+		},
+	}
+
+	cmd.AddCommand(setCmd, listCmd, removeCmd, defaultCmd)
+	return cmd
+}
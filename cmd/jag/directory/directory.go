@@ -119,22 +119,48 @@ func GetESP32CachePath() (string, error) {
 	return imagePath, nil
 }
 
-func GetToitToolchainPath() (string, error) {
+// GetChipToolchainPath returns the path of the toolchain files (like the
+// partition table) for the given chip variant.
+func GetChipToolchainPath(chip string) (string, error) {
 	repoPath, ok := getRepoPath()
 	if ok {
-		return filepath.Join(repoPath, "toolchains", "esp32"), nil
+		return filepath.Join(repoPath, "toolchains", chip), nil
 	}
 
-	return GetESP32CachePath()
+	return getChipCachePath(chip)
 }
 
 func GetESP32ImagePath() (string, error) {
+	return GetChipImagePath("esp32")
+}
+
+// GetChipImagePath returns the path of the firmware image for the given
+// chip variant.
+func GetChipImagePath(chip string) (string, error) {
 	repoPath, ok := getRepoPath()
 	if ok {
-		return filepath.Join(repoPath, "build", "esp32"), nil
+		return filepath.Join(repoPath, "build", chip), nil
 	}
 
-	return GetESP32CachePath()
+	return getChipCachePath(chip)
+}
+
+// The image for the ESP32 is stored at the root of the image cache and
+// the images for the other chip variants are stored in subdirectories
+// named after the chip. 'jag setup' only installs the ESP32 image.
+func getChipCachePath(chip string) (string, error) {
+	imagePath, err := GetESP32CachePath()
+	if err != nil {
+		return "", err
+	}
+	if chip == "esp32" {
+		return imagePath, nil
+	}
+	chipPath := filepath.Join(imagePath, chip)
+	if stat, err := os.Stat(chipPath); err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("there is no %s image in '%s'.\n'jag setup' only installs the esp32 image, the images for other chips must be put there", chip, chipPath)
+	}
+	return chipPath, nil
 }
 
 func getImageSnapshotPath(name string) (string, error) {
@@ -170,31 +196,6 @@ func GetSystemSnapshotPath() (string, error) {
 	return getImageSnapshotPath("system.snapshot")
 }
 
-func GetEsptoolCachePath() (string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(home, ".cache", "jaguar", Executable("esptool")), nil
-}
-
-func GetEsptoolPath() (string, error) {
-	repoPath, ok := getRepoPath()
-	if ok {
-		return filepath.Join(repoPath, "third_party", "esp-idf", "components", "esptool_py", "esptool", "esptool.py"), nil
-	}
-
-	cachePath, err := GetEsptoolCachePath()
-	if err != nil {
-		return "", err
-	}
-
-	if stat, err := os.Stat(cachePath); err != nil || stat.IsDir() {
-		return "", fmt.Errorf("the path '%s' did not hold the esptool.\nYou must setup the esptool using 'jag setup'", cachePath)
-	}
-	return cachePath, nil
-}
-
 func ensureDirectory(dir string, err error) (string, error) {
 	if err != nil {
 		return dir, err
@@ -0,0 +1,163 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Chip describes the parts of an ESP chip's ROM bootloader and flash
+// interface that differ between chip variants.
+type Chip struct {
+	Name string
+
+	// Where the second stage bootloader is stored in flash.
+	BootloaderOffset uint32
+
+	// The flash parameters used unless told otherwise.
+	DefaultFlashMode string
+	DefaultFlashFreq string
+
+	// The values found in the chip detection register.
+	magicValues []uint32
+
+	// The newer ROM bootloaders take an extra argument to the flash
+	// begin commands that tells whether the data is encrypted.
+	supportsEncryptedFlash bool
+	// Only the ROM bootloader of the ESP32 can read the flash. The newer
+	// ones leave that to a stub loaded into RAM, which we don't have.
+	supportsReadFlash bool
+
+	// The address of the SPI flash controller registers and the offsets
+	// of the individual registers, used to run raw SPI flash commands.
+	spiRegBase    uint32
+	spiUsrOffs    uint32
+	spiUsr1Offs   uint32
+	spiUsr2Offs   uint32
+	spiW0Offs     uint32
+	spiMosiDlOffs uint32
+	spiMisoDlOffs uint32
+}
+
+func (c *Chip) String() string {
+	return c.Name
+}
+
+// CanReadFlash returns whether the flash of the chip can be read with
+// ReadFlash.
+func (c *Chip) CanReadFlash() bool {
+	return c.supportsReadFlash
+}
+
+var ESP32 = &Chip{
+	Name:             "esp32",
+	BootloaderOffset: 0x1000,
+	DefaultFlashMode: "dio",
+	DefaultFlashFreq: "40m",
+
+	magicValues:       []uint32{0x00f01d83},
+	supportsReadFlash: true,
+
+	spiRegBase:    0x3ff42000,
+	spiUsrOffs:    0x1c,
+	spiUsr1Offs:   0x20,
+	spiUsr2Offs:   0x24,
+	spiW0Offs:     0x80,
+	spiMosiDlOffs: 0x28,
+	spiMisoDlOffs: 0x2c,
+}
+
+var ESP32S2 = &Chip{
+	Name:             "esp32s2",
+	BootloaderOffset: 0x1000,
+	DefaultFlashMode: "dio",
+	DefaultFlashFreq: "80m",
+
+	magicValues:            []uint32{0x000007c6},
+	supportsEncryptedFlash: true,
+
+	spiRegBase:    0x3f402000,
+	spiUsrOffs:    0x18,
+	spiUsr1Offs:   0x1c,
+	spiUsr2Offs:   0x20,
+	spiW0Offs:     0x58,
+	spiMosiDlOffs: 0x24,
+	spiMisoDlOffs: 0x28,
+}
+
+var ESP32S3 = &Chip{
+	Name:             "esp32s3",
+	BootloaderOffset: 0x0,
+	DefaultFlashMode: "dio",
+	DefaultFlashFreq: "80m",
+
+	magicValues:            []uint32{0x00000009},
+	supportsEncryptedFlash: true,
+
+	spiRegBase:    0x60002000,
+	spiUsrOffs:    0x18,
+	spiUsr1Offs:   0x1c,
+	spiUsr2Offs:   0x20,
+	spiW0Offs:     0x58,
+	spiMosiDlOffs: 0x24,
+	spiMisoDlOffs: 0x28,
+}
+
+var ESP32C3 = &Chip{
+	Name:             "esp32c3",
+	BootloaderOffset: 0x0,
+	DefaultFlashMode: "dio",
+	DefaultFlashFreq: "80m",
+
+	magicValues:            []uint32{0x6921506f, 0x1b31506f, 0x4881606f},
+	supportsEncryptedFlash: true,
+
+	spiRegBase:    0x60002000,
+	spiUsrOffs:    0x18,
+	spiUsr1Offs:   0x1c,
+	spiUsr2Offs:   0x20,
+	spiW0Offs:     0x58,
+	spiMosiDlOffs: 0x24,
+	spiMisoDlOffs: 0x28,
+}
+
+var Chips = []*Chip{ESP32, ESP32S2, ESP32S3, ESP32C3}
+
+// ChipNames returns the names of the supported chips.
+func ChipNames() []string {
+	var res []string
+	for _, c := range Chips {
+		res = append(res, c.Name)
+	}
+	return res
+}
+
+// ChipByName finds a chip by name, ignoring case and dashes, so both
+// 'esp32s3' and 'ESP32-S3' work.
+func ChipByName(name string) (*Chip, error) {
+	normalized := strings.ReplaceAll(strings.ToLower(name), "-", "")
+	for _, c := range Chips {
+		if c.Name == normalized {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported chip '%s'. Must be one of %s", name, strings.Join(ChipNames(), ", "))
+}
+
+// The ROM bootloaders of all chips have a register at this address with
+// a value that tells the chip variants apart.
+const chipDetectMagicRegAddr = 0x40001000
+
+func chipByMagic(magic uint32) (*Chip, error) {
+	for _, c := range Chips {
+		for _, m := range c.magicValues {
+			if m == magic {
+				return c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported chip (magic value 0x%08x)", magic)
+}
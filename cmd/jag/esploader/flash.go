@@ -0,0 +1,377 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Image is a piece of data to be written to flash at a given offset.
+type Image struct {
+	Name   string
+	Offset uint32
+	Data   []byte
+}
+
+type FlashOptions struct {
+	// The baud rate used for writing. The ROM bootloader is told to
+	// switch to it after connecting.
+	BaudRate int
+	// The SPI flash mode (qio, qout, dio or dout), frequency (80m, 40m,
+	// 26m or 20m) and size (like 4MB). The size can also be 'detect'
+	// to read it from the flash chip or 'keep' to leave it as it is in
+	// the bootloader image. The mode and frequency default to the ones
+	// of the chip.
+	FlashMode string
+	FlashFreq string
+	FlashSize string
+	// Called as the data is written, if set. The sizes are in bytes of
+	// uncompressed data across all images.
+	Progress func(written int, total int)
+}
+
+var flashModes = map[string]byte{
+	"qio":  0,
+	"qout": 1,
+	"dio":  2,
+	"dout": 3,
+}
+
+var flashFreqs = map[string]byte{
+	"40m": 0x0,
+	"26m": 0x1,
+	"20m": 0x2,
+	"80m": 0xf,
+}
+
+var flashSizes = map[string]uint32{
+	"1MB":  1 << 20,
+	"2MB":  2 << 20,
+	"4MB":  4 << 20,
+	"8MB":  8 << 20,
+	"16MB": 16 << 20,
+}
+
+var flashSizeIDs = map[uint32]byte{
+	1 << 20:  0x0,
+	2 << 20:  0x1,
+	4 << 20:  0x2,
+	8 << 20:  0x3,
+	16 << 20: 0x4,
+}
+
+// ParseFlashSize parses a flash size like '4MB'.
+func ParseFlashSize(size string) (uint32, error) {
+	res, ok := flashSizes[strings.ToUpper(size)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported flash size '%s'", size)
+	}
+	return res, nil
+}
+
+// WriteFlash writes the images to flash using compressed writes and
+// verifies the result using the MD5 digests computed by the chip.
+func (l *Loader) WriteFlash(images []Image, options FlashOptions) error {
+	if options.BaudRate != 0 && options.BaudRate != romBaudRate {
+		if err := l.ChangeBaudRate(options.BaudRate); err != nil {
+			return fmt.Errorf("failed to change baud rate: %w", err)
+		}
+	}
+
+	if err := l.spiAttach(); err != nil {
+		return fmt.Errorf("failed to attach SPI flash: %w", err)
+	}
+
+	var flashSize uint32
+	switch strings.ToLower(options.FlashSize) {
+	case "", "keep":
+	case "detect":
+		size, err := l.DetectFlashSize()
+		if err != nil {
+			return err
+		}
+		flashSize = size
+	default:
+		size, err := ParseFlashSize(options.FlashSize)
+		if err != nil {
+			return err
+		}
+		flashSize = size
+	}
+	if flashSize != 0 {
+		if err := l.spiSetParams(flashSize); err != nil {
+			return fmt.Errorf("failed to set flash parameters: %w", err)
+		}
+	}
+
+	flashMode := options.FlashMode
+	if flashMode == "" {
+		flashMode = l.chip.DefaultFlashMode
+	}
+	flashFreq := options.FlashFreq
+	if flashFreq == "" {
+		flashFreq = l.chip.DefaultFlashFreq
+	}
+
+	var prepared []Image
+	total := 0
+	for _, image := range images {
+		data := image.Data
+		if len(data)%4 != 0 {
+			// Pad a copy, so we never write into the array of the caller.
+			padded := bytes.Repeat([]byte{0xff}, len(data)+4-len(data)%4)
+			copy(padded, data)
+			data = padded
+		}
+		if image.Offset == l.chip.BootloaderOffset {
+			patched, err := patchImageHeader(data, flashMode, flashFreq, flashSize)
+			if err != nil {
+				return err
+			}
+			data = patched
+		}
+		image.Data = data
+		prepared = append(prepared, image)
+		total += len(data)
+	}
+
+	done := 0
+	for _, image := range prepared {
+		progress := func(written int) {
+			if options.Progress != nil {
+				options.Progress(done+written, total)
+			}
+		}
+		if err := l.writeImage(image, progress); err != nil {
+			return fmt.Errorf("failed to write %s at 0x%x: %w", image.Name, image.Offset, err)
+		}
+		done += len(image.Data)
+	}
+
+	return l.flashFinish()
+}
+
+func (l *Loader) writeImage(image Image, progress func(written int)) error {
+	var compressed bytes.Buffer
+	w, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(image.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := l.flashDeflBegin(len(image.Data), compressed.Len(), image.Offset); err != nil {
+		return err
+	}
+
+	// The timeout for each block depends on how much uncompressed data
+	// the chip has to write.
+	ratio := float64(len(image.Data)) / float64(compressed.Len())
+	blockTimeout := timeoutPerMB(writeTimeoutPerMB, int(ratio*flashWriteSize))
+
+	c := compressed.Bytes()
+	for seq := 0; len(c) > 0; seq++ {
+		n := flashWriteSize
+		if n > len(c) {
+			n = len(c)
+		}
+		if err := l.flashDeflData(c[:n], seq, blockTimeout); err != nil {
+			return err
+		}
+		c = c[n:]
+		written := int(float64(compressed.Len()-len(c)) * ratio)
+		if written > len(image.Data) || len(c) == 0 {
+			written = len(image.Data)
+		}
+		progress(written)
+	}
+
+	expected := md5.Sum(image.Data)
+	actual, err := l.FlashMD5(image.Offset, len(image.Data))
+	if err != nil {
+		return err
+	}
+	if actual != hex.EncodeToString(expected[:]) {
+		return fmt.Errorf("MD5 of written data does not match (expected %x, got %s)", expected, actual)
+	}
+	return nil
+}
+
+// patchImageHeader updates the SPI flash parameters in the header of the
+// bootloader image. The bootloader uses these parameters to talk to the
+// flash. If the image has a SHA256 digest appended, it is recomputed.
+func patchImageHeader(data []byte, mode string, freq string, size uint32) ([]byte, error) {
+	const (
+		imageMagic      = 0xe9
+		headerLength    = 24
+		hashAppendedPos = 23
+	)
+	if len(data) < headerLength || data[0] != imageMagic {
+		// Not an image, so there is nothing to patch.
+		return data, nil
+	}
+
+	res := append([]byte(nil), data...)
+	if mode != "" && mode != "keep" {
+		m, ok := flashModes[strings.ToLower(mode)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported flash mode '%s'", mode)
+		}
+		res[2] = m
+	}
+	if freq != "" && freq != "keep" {
+		f, ok := flashFreqs[strings.ToLower(freq)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported flash frequency '%s'", freq)
+		}
+		res[3] = (res[3] & 0xf0) | f
+	}
+	if size != 0 {
+		s, ok := flashSizeIDs[size]
+		if !ok {
+			return nil, fmt.Errorf("unsupported flash size %d", size)
+		}
+		res[3] = (res[3] & 0x0f) | (s << 4)
+	}
+
+	if res[hashAppendedPos] == 1 {
+		end, err := imageChecksumEnd(res)
+		if err != nil {
+			return nil, err
+		}
+		if end+sha256.Size <= len(res) {
+			digest := sha256.Sum256(res[:end])
+			copy(res[end:], digest[:])
+		}
+	}
+	return res, nil
+}
+
+// imageChecksumEnd returns the position right after the checksum byte
+// of an image, which is where the SHA256 digest starts.
+func imageChecksumEnd(data []byte) (int, error) {
+	const headerLength = 24
+	segments := int(data[1])
+	pos := headerLength
+	for i := 0; i < segments; i++ {
+		if pos+8 > len(data) {
+			return 0, fmt.Errorf("malformed image: segment %d is out of bounds", i)
+		}
+		pos += 8 + int(binary.LittleEndian.Uint32(data[pos+4:]))
+	}
+	// The checksum byte is placed at the end of a 16 byte aligned block.
+	pos += 15 - pos%16
+	return pos + 1, nil
+}
+
+// MergeImages combines the images into a single image that can be written
+// to flash at offset 0 by other tools. Gaps between the images are filled
+// with 0xff like erased flash. The flash parameters in the header of the
+// bootloader are patched like WriteFlash does it, except that the flash
+// size cannot be detected.
+func MergeImages(chip *Chip, images []Image, options FlashOptions) ([]byte, error) {
+	var flashSize uint32
+	switch strings.ToLower(options.FlashSize) {
+	case "", "keep":
+	case "detect":
+		return nil, fmt.Errorf("the flash size cannot be detected for a merged image")
+	default:
+		size, err := ParseFlashSize(options.FlashSize)
+		if err != nil {
+			return nil, err
+		}
+		flashSize = size
+	}
+
+	flashMode := options.FlashMode
+	if flashMode == "" {
+		flashMode = chip.DefaultFlashMode
+	}
+	flashFreq := options.FlashFreq
+	if flashFreq == "" {
+		flashFreq = chip.DefaultFlashFreq
+	}
+
+	end := 0
+	for _, image := range images {
+		if e := int(image.Offset) + len(image.Data); e > end {
+			end = e
+		}
+	}
+	if flashSize != 0 && end > int(flashSize) {
+		return nil, fmt.Errorf("the images end at 0x%x, beyond the end of the flash", end)
+	}
+
+	res := bytes.Repeat([]byte{0xff}, end)
+	for _, image := range images {
+		data := image.Data
+		if image.Offset == chip.BootloaderOffset {
+			patched, err := patchImageHeader(data, flashMode, flashFreq, flashSize)
+			if err != nil {
+				return nil, err
+			}
+			data = patched
+		}
+		copy(res[image.Offset:], data)
+	}
+	return res, nil
+}
+
+// ReadFlash reads a region of the flash using the slow read command of
+// the ROM bootloader. Every command reads 64 bytes, so the speed is
+// limited by the round trips rather than the baud rate: reading 4MB
+// takes several minutes. Only the ROM bootloader of the ESP32 has the
+// command. The data is verified against the MD5 digest computed by the
+// chip.
+func (l *Loader) ReadFlash(offset uint32, size int, progress func(read int)) ([]byte, error) {
+	if !l.chip.supportsReadFlash {
+		return nil, fmt.Errorf("the ROM bootloader of the %s can't read the flash", l.chip)
+	}
+
+	if err := l.spiAttach(); err != nil {
+		return nil, fmt.Errorf("failed to attach SPI flash: %w", err)
+	}
+
+	res := make([]byte, 0, size)
+	for len(res) < size {
+		n := size - len(res)
+		if n > flashReadSlowSize {
+			n = flashReadSlowSize
+		}
+		address := offset + uint32(len(res))
+		_, body, err := l.command(opReadFlashSlow, pack(address, uint32(n)), 0, defaultTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read flash at 0x%x: %w", address, err)
+		}
+		if len(body) < n {
+			return nil, fmt.Errorf("short read of flash at 0x%x", address)
+		}
+		res = append(res, body[:n]...)
+		if progress != nil {
+			progress(len(res))
+		}
+	}
+
+	expected := md5.Sum(res)
+	actual, err := l.FlashMD5(offset, size)
+	if err != nil {
+		return nil, err
+	}
+	if actual != hex.EncodeToString(expected[:]) {
+		return nil, fmt.Errorf("MD5 of read data does not match (expected %s, got %x)", actual, expected)
+	}
+	return res, nil
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func connectFake(t *testing.T, chip *Chip, flashSize int) (*fakeROM, *Loader) {
+	rom := newFakeROM(chip, flashSize)
+	loader := NewLoader(rom)
+	if err := loader.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return rom, loader
+}
+
+func randomData(size int) []byte {
+	res := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(res)
+	return res
+}
+
+func TestWriteFlash(t *testing.T) {
+	for _, chip := range Chips {
+		t.Run(chip.Name, func(t *testing.T) {
+			rom, loader := connectFake(t, chip, 0x40000)
+			images := []Image{
+				// Several blocks of data that doesn't compress well.
+				{Name: "random", Offset: 0x10000, Data: randomData(3*flashWriteSize + 17)},
+				{Name: "zeros", Offset: 0x20000, Data: make([]byte, 0x8000)},
+			}
+			written := 0
+			options := FlashOptions{
+				Progress: func(w int, total int) { written = w },
+			}
+			if err := loader.WriteFlash(images, options); err != nil {
+				t.Fatalf("WriteFlash: %v", err)
+			}
+			for _, image := range images {
+				got := rom.flash[image.Offset : int(image.Offset)+len(image.Data)]
+				if !bytes.Equal(got, image.Data) {
+					t.Errorf("%s was not written correctly", image.Name)
+				}
+			}
+			// The padding of the first image is written as erased flash.
+			end := 0x10000 + 3*flashWriteSize + 17
+			if !bytes.Equal(rom.flash[end:end+3], []byte{0xff, 0xff, 0xff}) {
+				t.Errorf("padding = % x, want ff ff ff", rom.flash[end:end+3])
+			}
+			if want := 3*flashWriteSize + 20 + 0x8000; written != want {
+				t.Errorf("progress ended at %d, want %d", written, want)
+			}
+			if n := len(rom.commandsWith(opSpiFlashMD5)); n != len(images) {
+				t.Errorf("checked %d MD5 digests, want %d", n, len(images))
+			}
+			if n := len(rom.commandsWith(opFlashDeflEnd)); n != 1 {
+				t.Errorf("sent %d FLASH_DEFL_END, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWriteFlashBeginLength(t *testing.T) {
+	// The ROM bootloaders of the newer chips take an extra word telling
+	// whether the data is encrypted.
+	for _, chip := range Chips {
+		t.Run(chip.Name, func(t *testing.T) {
+			rom, loader := connectFake(t, chip, 0x20000)
+			images := []Image{{Name: "app", Offset: 0x10000, Data: randomData(100)}}
+			if err := loader.WriteFlash(images, FlashOptions{}); err != nil {
+				t.Fatalf("WriteFlash: %v", err)
+			}
+			want := 16
+			if chip != ESP32 {
+				want = 20
+			}
+			for _, op := range []byte{opFlashDeflBegin, opFlashBegin} {
+				for _, c := range rom.commandsWith(op) {
+					if len(c.data) != want {
+						t.Errorf("command 0x%02x has %d bytes of data, want %d", op, len(c.data), want)
+					}
+				}
+			}
+			begin := rom.commandsWith(opFlashDeflBegin)[0].data
+			if chip != ESP32 && binary.LittleEndian.Uint32(begin[16:]) != 0 {
+				t.Errorf("FLASH_DEFL_BEGIN asked for encryption")
+			}
+		})
+	}
+}
+
+func TestWriteFlashMD5Mismatch(t *testing.T) {
+	rom, loader := connectFake(t, ESP32, 0x20000)
+	rom.corrupt = true
+	images := []Image{{Name: "app", Offset: 0x10000, Data: randomData(2000)}}
+	err := loader.WriteFlash(images, FlashOptions{})
+	if err == nil || !strings.Contains(err.Error(), "MD5") {
+		t.Errorf("WriteFlash = %v, want an MD5 mismatch", err)
+	}
+}
+
+func TestWriteFlashKeepsCallerData(t *testing.T) {
+	_, loader := connectFake(t, ESP32, 0x20000)
+	backing := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	images := []Image{{Name: "app", Offset: 0x10000, Data: backing[:5]}}
+	if err := loader.WriteFlash(images, FlashOptions{}); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(backing, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("padding overwrote the data of the caller: % x", backing)
+	}
+	if len(images[0].Data) != 5 {
+		t.Errorf("the image of the caller was changed")
+	}
+}
+
+func TestWriteFlashPatchesBootloader(t *testing.T) {
+	rom, loader := connectFake(t, ESP32, 0x20000)
+	bootloader := make([]byte, 64)
+	bootloader[0] = 0xe9
+	images := []Image{{Name: "bootloader", Offset: ESP32.BootloaderOffset, Data: bootloader}}
+	if err := loader.WriteFlash(images, FlashOptions{FlashMode: "qio", FlashFreq: "80m", FlashSize: "4MB"}); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	header := rom.flash[ESP32.BootloaderOffset:]
+	if header[2] != 0x00 || header[3] != 0x2f {
+		t.Errorf("flash parameters = %02x %02x, want 00 2f", header[2], header[3])
+	}
+	if bootloader[2] != 0 || bootloader[3] != 0 {
+		t.Errorf("the bootloader of the caller was patched")
+	}
+}
+
+func TestReadFlashUnsupported(t *testing.T) {
+	for _, chip := range []*Chip{ESP32S2, ESP32S3, ESP32C3} {
+		t.Run(chip.Name, func(t *testing.T) {
+			rom, loader := connectFake(t, chip, 0x2000)
+			if _, err := loader.ReadFlash(0, 0x100, nil); err == nil {
+				t.Errorf("ReadFlash succeeded")
+			}
+			if n := len(rom.commandsWith(opReadFlashSlow)); n != 0 {
+				t.Errorf("sent %d READ_FLASH_SLOW commands, want 0", n)
+			}
+		})
+	}
+}
+
+func TestReadFlash(t *testing.T) {
+	rom, loader := connectFake(t, ESP32, 0x2000)
+	want := randomData(0x200 + 5)
+	copy(rom.flash[0x1000:], want)
+	got, err := loader.ReadFlash(0x1000, len(want), nil)
+	if err != nil {
+		t.Fatalf("ReadFlash: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadFlash returned the wrong data")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// AppImage describes an application image in the format the bootloader
+// loads from flash.
+type AppImage struct {
+	// The length of the image including the checksum and the appended
+	// SHA256 digest, if any.
+	Length int
+	// The SHA256 digest of the image, excluding the appended digest.
+	SHA256 string
+	// Whether the image has a SHA256 digest appended and if so, whether
+	// it matches the content.
+	DigestAppended bool
+	DigestValid    bool
+
+	// The application description embedded in the image by the ESP-IDF.
+	Version     string
+	ProjectName string
+	BuildTime   string
+	BuildDate   string
+	IDFVersion  string
+	ELFSHA256   string
+}
+
+// ParseAppImage parses the header and the application description of the
+// application image at the start of data. Data after the image is
+// ignored, so data can be the content of an entire app partition.
+func ParseAppImage(data []byte) (*AppImage, error) {
+	const (
+		imageMagic      = 0xe9
+		headerLength    = 24
+		hashAppendedPos = 23
+		// The application description is at the start of the first
+		// segment, right after the segment header.
+		appDescOffset = headerLength + 8
+		appDescMagic  = 0xabcd5432
+		appDescLength = 256
+	)
+	if len(data) < headerLength || data[0] != imageMagic {
+		return nil, fmt.Errorf("not an application image")
+	}
+
+	end, err := imageChecksumEnd(data)
+	if err != nil {
+		return nil, err
+	}
+	if end > len(data) {
+		return nil, fmt.Errorf("malformed image: image is truncated")
+	}
+
+	res := &AppImage{
+		Length:         end,
+		DigestAppended: data[hashAppendedPos] == 1,
+	}
+	digest := sha256.Sum256(data[:end])
+	res.SHA256 = hex.EncodeToString(digest[:])
+	if res.DigestAppended {
+		res.Length += sha256.Size
+		if res.Length > len(data) {
+			return nil, fmt.Errorf("malformed image: digest is truncated")
+		}
+		res.DigestValid = bytes.Equal(data[end:end+sha256.Size], digest[:])
+	}
+
+	if len(data) >= appDescOffset+appDescLength && binary.LittleEndian.Uint32(data[appDescOffset:]) == appDescMagic {
+		desc := data[appDescOffset : appDescOffset+appDescLength]
+		cString := func(b []byte) string {
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+			return string(b)
+		}
+		res.Version = cString(desc[16:48])
+		res.ProjectName = cString(desc[48:80])
+		res.BuildTime = cString(desc[80:96])
+		res.BuildDate = cString(desc[96:112])
+		res.IDFVersion = cString(desc[112:144])
+		res.ELFSHA256 = hex.EncodeToString(desc[144:176])
+	}
+	return res, nil
+}
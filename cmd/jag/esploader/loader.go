@@ -0,0 +1,432 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+// Package esploader implements the serial protocol spoken by the ROM
+// bootloader of the ESP32 family of chips. It is used to write the
+// Jaguar firmware to flash without depending on external tools.
+package esploader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Port is the subset of serial.Port used by the loader. It makes it
+// possible to talk to something that isn't a real serial port, like a
+// pseudo-terminal.
+type Port interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	SetMode(mode *serial.Mode) error
+	SetReadTimeout(t time.Duration) error
+	ResetInputBuffer() error
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+	Close() error
+}
+
+var ErrTimeout = errors.New("timed out waiting for packet")
+
+const (
+	romBaudRate = 115200
+
+	opFlashBegin     = 0x02
+	opFlashData      = 0x03
+	opFlashEnd       = 0x04
+	opSync           = 0x08
+	opWriteReg       = 0x09
+	opReadReg        = 0x0a
+	opSpiSetParams   = 0x0b
+	opSpiAttach      = 0x0d
+	opReadFlashSlow  = 0x0e
+	opChangeBaudRate = 0x0f
+	opFlashDeflBegin = 0x10
+	opFlashDeflData  = 0x11
+	opFlashDeflEnd   = 0x12
+	opSpiFlashMD5    = 0x13
+
+	// The ROM bootloader writes flash in blocks of this size.
+	flashWriteSize = 0x400
+	// The ROM bootloader can read at most this much flash at a time.
+	flashReadSlowSize = 64
+	flashSectorSize   = 0x1000
+
+	checksumMagic = 0xef
+
+	// The ROM bootloaders of the ESP32 family end their responses with
+	// four status bytes.
+	statusLength = 4
+
+	defaultTimeout    = 3 * time.Second
+	syncTimeout       = 100 * time.Millisecond
+	md5TimeoutPerMB   = 8 * time.Second
+	eraseTimeoutPerMB = 30 * time.Second
+	writeTimeoutPerMB = 40 * time.Second
+)
+
+var romErrors = map[byte]string{
+	0x05: "received message is invalid",
+	0x06: "failed to act on received message",
+	0x07: "invalid CRC in message",
+	0x08: "flash write error",
+	0x09: "flash read error",
+	0x0a: "flash read length error",
+	0x0b: "deflate error",
+}
+
+type Loader struct {
+	port   Port
+	reader slipReader
+	chip   *Chip
+}
+
+// Open opens the serial port with the given name at the baud rate the
+// ROM bootloader starts out with.
+func Open(name string) (*Loader, error) {
+	port, err := serial.Open(name, &serial.Mode{BaudRate: romBaudRate})
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("the port '%s' was not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewLoader(port), nil
+}
+
+func NewLoader(port Port) *Loader {
+	return &Loader{
+		port:   port,
+		reader: slipReader{port: port},
+		chip:   ESP32,
+	}
+}
+
+func (l *Loader) Close() error {
+	return l.port.Close()
+}
+
+// Chip returns the chip detected when connecting.
+func (l *Loader) Chip() *Chip {
+	return l.chip
+}
+
+// resetIntoBootloader uses the DTR and RTS lines, which are connected
+// to the IO0 and EN pins on most development boards, to reset the chip
+// while keeping IO0 low. That makes the chip start the ROM bootloader.
+func (l *Loader) resetIntoBootloader() {
+	l.port.SetDTR(false) // IO0 high.
+	l.port.SetRTS(true)  // EN low, chip in reset.
+	time.Sleep(100 * time.Millisecond)
+	l.port.SetDTR(true)  // IO0 low.
+	l.port.SetRTS(false) // EN high, chip out of reset.
+	time.Sleep(50 * time.Millisecond)
+	l.port.SetDTR(false) // IO0 high again.
+}
+
+// HardReset resets the chip and lets it boot normally.
+func (l *Loader) HardReset() {
+	l.port.SetDTR(false)
+	l.port.SetRTS(true)
+	time.Sleep(100 * time.Millisecond)
+	l.port.SetRTS(false)
+}
+
+// Connect resets the chip into the ROM bootloader and synchronizes with
+// it, so it is ready to receive commands.
+func (l *Loader) Connect() error {
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		l.resetIntoBootloader()
+		l.port.ResetInputBuffer()
+		l.reader.reset()
+		for i := 0; i < 5; i++ {
+			if lastErr = l.sync(); lastErr == nil {
+				return l.detectChip()
+			}
+		}
+	}
+	return fmt.Errorf("failed to connect to the ROM bootloader: %w", lastErr)
+}
+
+func (l *Loader) detectChip() error {
+	magic, err := l.ReadReg(chipDetectMagicRegAddr)
+	if err != nil {
+		return fmt.Errorf("failed to detect chip: %w", err)
+	}
+	chip, err := chipByMagic(magic)
+	if err != nil {
+		return err
+	}
+	l.chip = chip
+	return nil
+}
+
+func (l *Loader) sync() error {
+	data := []byte{0x07, 0x07, 0x12, 0x20}
+	for i := 0; i < 32; i++ {
+		data = append(data, 0x55)
+	}
+	if _, _, err := l.command(opSync, data, 0, syncTimeout); err != nil {
+		return err
+	}
+	// The ROM bootloader answers a sync with several responses. Drain
+	// them, so they aren't mistaken for responses to later commands.
+	for {
+		if _, err := l.reader.readPacket(syncTimeout); err != nil {
+			return nil
+		}
+	}
+}
+
+func checksum(data []byte) uint32 {
+	res := uint32(checksumMagic)
+	for _, b := range data {
+		res ^= uint32(b)
+	}
+	return res
+}
+
+// command sends a command to the ROM bootloader and waits for the
+// response. It returns the value field and the data of the response,
+// excluding the status bytes.
+func (l *Loader) command(op byte, data []byte, check uint32, timeout time.Duration) (uint32, []byte, error) {
+	packet := make([]byte, 8, 8+len(data))
+	packet[0] = 0x00 // Request.
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], check)
+	packet = append(packet, data...)
+	if _, err := l.port.Write(slipEncode(packet)); err != nil {
+		return 0, nil, err
+	}
+
+	// Other responses might still be in flight, so we skip responses
+	// that aren't for this command.
+	for retries := 0; retries < 100; retries++ {
+		response, err := l.reader.readPacket(timeout)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(response) < 8 || response[0] != 0x01 || response[1] != op {
+			continue
+		}
+
+		value := binary.LittleEndian.Uint32(response[4:])
+		body := response[8:]
+		if len(body) < statusLength {
+			return 0, nil, fmt.Errorf("response to command 0x%02x was too short", op)
+		}
+		status := body[len(body)-statusLength:]
+		if status[0] != 0 {
+			reason, ok := romErrors[status[1]]
+			if !ok {
+				reason = fmt.Sprintf("unknown error 0x%02x", status[1])
+			}
+			return 0, nil, fmt.Errorf("command 0x%02x failed: %s", op, reason)
+		}
+		return value, body[:len(body)-statusLength], nil
+	}
+	return 0, nil, fmt.Errorf("didn't get a response to command 0x%02x", op)
+}
+
+func pack(values ...uint32) []byte {
+	res := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(res[4*i:], v)
+	}
+	return res
+}
+
+func (l *Loader) ReadReg(address uint32) (uint32, error) {
+	value, _, err := l.command(opReadReg, pack(address), 0, defaultTimeout)
+	return value, err
+}
+
+func (l *Loader) WriteReg(address uint32, value uint32) error {
+	_, _, err := l.command(opWriteReg, pack(address, value, 0xffffffff, 0), 0, defaultTimeout)
+	return err
+}
+
+// ChangeBaudRate switches both the chip and the port to a new baud rate.
+func (l *Loader) ChangeBaudRate(baud int) error {
+	if _, _, err := l.command(opChangeBaudRate, pack(uint32(baud), 0), 0, defaultTimeout); err != nil {
+		return err
+	}
+	if err := l.port.SetMode(&serial.Mode{BaudRate: baud}); err != nil {
+		return err
+	}
+	// Give the chip a moment to switch before talking to it again.
+	time.Sleep(50 * time.Millisecond)
+	l.reader.reset()
+	return l.port.ResetInputBuffer()
+}
+
+func (l *Loader) spiAttach() error {
+	_, _, err := l.command(opSpiAttach, pack(0, 0), 0, defaultTimeout)
+	return err
+}
+
+func (l *Loader) spiSetParams(size uint32) error {
+	const (
+		blockSize  = 64 * 1024
+		pageSize   = 256
+		statusMask = 0xffff
+	)
+	_, _, err := l.command(opSpiSetParams, pack(0, size, blockSize, flashSectorSize, pageSize, statusMask), 0, defaultTimeout)
+	return err
+}
+
+// SetFlashSize tells the ROM bootloader how big the flash is. Without it
+// the ROM bootloader may refuse to access the end of larger flash chips.
+func (l *Loader) SetFlashSize(size uint32) error {
+	if err := l.spiAttach(); err != nil {
+		return fmt.Errorf("failed to attach SPI flash: %w", err)
+	}
+	return l.spiSetParams(size)
+}
+
+// runSpiFlashCommand makes the SPI flash controller send a command to
+// the flash chip and returns up to 32 bits read back from the flash.
+func (l *Loader) runSpiFlashCommand(command uint32, readBits uint32) (uint32, error) {
+	const (
+		spiUsrCommand          = 1 << 31
+		spiUsrMiso             = 1 << 28
+		spiCmdUsr              = 1 << 18
+		spiUsr2CommandLenShift = 28
+	)
+	c := l.chip
+	cmdReg := c.spiRegBase
+	usrReg := c.spiRegBase + c.spiUsrOffs
+	usr2Reg := c.spiRegBase + c.spiUsr2Offs
+	w0Reg := c.spiRegBase + c.spiW0Offs
+
+	oldUsr, err := l.ReadReg(usrReg)
+	if err != nil {
+		return 0, err
+	}
+	oldUsr2, err := l.ReadReg(usr2Reg)
+	if err != nil {
+		return 0, err
+	}
+
+	flags := uint32(spiUsrCommand)
+	if readBits > 0 {
+		flags |= spiUsrMiso
+		if err := l.WriteReg(c.spiRegBase+c.spiMisoDlOffs, readBits-1); err != nil {
+			return 0, err
+		}
+	}
+	if err := l.WriteReg(usrReg, flags); err != nil {
+		return 0, err
+	}
+	if err := l.WriteReg(usr2Reg, (7<<spiUsr2CommandLenShift)|command); err != nil {
+		return 0, err
+	}
+	if err := l.WriteReg(w0Reg, 0); err != nil {
+		return 0, err
+	}
+	if err := l.WriteReg(cmdReg, spiCmdUsr); err != nil {
+		return 0, err
+	}
+
+	done := false
+	for i := 0; i < 10 && !done; i++ {
+		v, err := l.ReadReg(cmdReg)
+		if err != nil {
+			return 0, err
+		}
+		done = v&spiCmdUsr == 0
+	}
+	if !done {
+		return 0, fmt.Errorf("SPI flash command 0x%02x did not complete", command)
+	}
+
+	res, err := l.ReadReg(w0Reg)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.WriteReg(usrReg, oldUsr); err != nil {
+		return 0, err
+	}
+	if err := l.WriteReg(usr2Reg, oldUsr2); err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+// DetectFlashSize reads the JEDEC ID of the flash chip and derives the
+// size of the flash from it.
+func (l *Loader) DetectFlashSize() (uint32, error) {
+	const spiFlashRDID = 0x9f
+	if err := l.spiAttach(); err != nil {
+		return 0, fmt.Errorf("failed to attach SPI flash: %w", err)
+	}
+	id, err := l.runSpiFlashCommand(spiFlashRDID, 24)
+	if err != nil {
+		return 0, err
+	}
+	sizeID := (id >> 16) & 0xff
+	if sizeID < 0x12 || sizeID > 0x1a {
+		return 0, fmt.Errorf("unknown flash size (flash ID 0x%06x)", id)
+	}
+	return 1 << sizeID, nil
+}
+
+func timeoutPerMB(perMB time.Duration, size int) time.Duration {
+	res := time.Duration(float64(perMB) * float64(size) / 1e6)
+	if res < defaultTimeout {
+		return defaultTimeout
+	}
+	return res
+}
+
+func (l *Loader) flashDeflBegin(size int, compressedSize int, offset uint32) error {
+	blocks := (compressedSize + flashWriteSize - 1) / flashWriteSize
+	eraseBlocks := (size + flashWriteSize - 1) / flashWriteSize
+	eraseSize := eraseBlocks * flashWriteSize
+	data := pack(uint32(eraseSize), uint32(blocks), flashWriteSize, offset)
+	if l.chip.supportsEncryptedFlash {
+		data = append(data, pack(0)...)
+	}
+	_, _, err := l.command(opFlashDeflBegin, data, 0, timeoutPerMB(eraseTimeoutPerMB, eraseSize))
+	return err
+}
+
+func (l *Loader) flashDeflData(block []byte, seq int, timeout time.Duration) error {
+	data := append(pack(uint32(len(block)), uint32(seq), 0, 0), block...)
+	_, _, err := l.command(opFlashDeflData, data, checksum(block), timeout)
+	return err
+}
+
+// flashFinish leaves flash mode without making the ROM bootloader run
+// the application. We reset the chip ourselves afterwards.
+func (l *Loader) flashFinish() error {
+	data := pack(0, 0, flashWriteSize, 0)
+	if l.chip.supportsEncryptedFlash {
+		data = append(data, pack(0)...)
+	}
+	if _, _, err := l.command(opFlashBegin, data, 0, defaultTimeout); err != nil {
+		return err
+	}
+	_, _, err := l.command(opFlashDeflEnd, pack(1), 0, defaultTimeout)
+	return err
+}
+
+// FlashMD5 computes the MD5 digest of a region of the flash on the chip.
+// The ROM bootloader responds with the digest as a hex string.
+func (l *Loader) FlashMD5(offset uint32, size int) (string, error) {
+	_, body, err := l.command(opSpiFlashMD5, pack(offset, uint32(size), 0, 0), 0, timeoutPerMB(md5TimeoutPerMB, size))
+	if err != nil {
+		return "", err
+	}
+	if len(body) < 32 {
+		return "", fmt.Errorf("MD5 response was too short")
+	}
+	return string(body[:32]), nil
+}
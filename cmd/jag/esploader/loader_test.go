@@ -0,0 +1,65 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"testing"
+)
+
+func TestConnect(t *testing.T) {
+	for _, chip := range Chips {
+		t.Run(chip.Name, func(t *testing.T) {
+			rom := newFakeROM(chip, 0)
+			loader := NewLoader(rom)
+			if err := loader.Connect(); err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			if loader.Chip() != chip {
+				t.Errorf("Chip() = %v, want %v", loader.Chip(), chip)
+			}
+			if n := len(rom.commandsWith(opSync)); n != 1 {
+				t.Errorf("sent %d syncs, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSyncDrainsResponses(t *testing.T) {
+	rom := newFakeROM(ESP32, 0)
+	loader := NewLoader(rom)
+	if err := loader.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	// The extra responses to the sync must not be taken for the response
+	// to the next command.
+	rom.regs[0x1234] = 42
+	value, err := loader.ReadReg(0x1234)
+	if err != nil {
+		t.Fatalf("ReadReg: %v", err)
+	}
+	if value != 42 {
+		t.Errorf("ReadReg = %d, want 42", value)
+	}
+}
+
+func TestSyncWithoutResponse(t *testing.T) {
+	rom := newFakeROM(ESP32, 0)
+	rom.syncResponses = 0
+	loader := NewLoader(rom)
+	if err := loader.sync(); err != ErrTimeout {
+		t.Errorf("sync = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	rom := newFakeROM(ESP32, 0)
+	loader := NewLoader(rom)
+	if err := loader.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, _, err := loader.command(0x7f, nil, 0, defaultTimeout); err == nil {
+		t.Errorf("unknown command succeeded")
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// fakeROM is a Port that behaves like the ROM bootloader of a chip with
+// flash attached. It answers the commands the loader sends, so the
+// loader can be tested without hardware.
+type fakeROM struct {
+	chip  *Chip
+	flash []byte
+
+	// The number of responses sent for every sync, like the real ROM
+	// bootloader that sends several.
+	syncResponses int
+	// If set, every byte written to flash is inverted, so the MD5
+	// digests don't match.
+	corrupt bool
+
+	mu          sync.Mutex
+	output      []byte
+	readTimeout time.Duration
+	synced      bool
+	regs        map[uint32]uint32
+
+	// The state of the compressed write in progress.
+	deflOffset     uint32
+	deflBlocks     int
+	deflSeq        int
+	deflCompressed []byte
+
+	// The commands received so far, with their data.
+	commands []fakeCommand
+}
+
+type fakeCommand struct {
+	op   byte
+	data []byte
+}
+
+func newFakeROM(chip *Chip, flashSize int) *fakeROM {
+	return &fakeROM{
+		chip:          chip,
+		flash:         bytes.Repeat([]byte{0xff}, flashSize),
+		syncResponses: 8,
+		regs:          map[uint32]uint32{},
+		// The chip prints its boot messages before starting the ROM
+		// bootloader.
+		output: []byte("ets Jun  8 2016 00:22:57\r\nwaiting for download\r\n"),
+	}
+}
+
+// commandsWith returns the commands received with the given op code.
+func (r *fakeROM) commandsWith(op byte) []fakeCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []fakeCommand
+	for _, c := range r.commands {
+		if c.op == op {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func (r *fakeROM) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if len(r.output) == 0 {
+		timeout := r.readTimeout
+		r.mu.Unlock()
+		// Like a serial port, a read that times out returns nothing.
+		time.Sleep(timeout)
+		return 0, nil
+	}
+	defer r.mu.Unlock()
+	n := copy(p, r.output)
+	r.output = r.output[n:]
+	return n, nil
+}
+
+func (r *fakeROM) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The loader writes every packet with a single write.
+	if len(p) < 2 || p[0] != slipEnd || p[len(p)-1] != slipEnd {
+		return 0, fmt.Errorf("not a SLIP packet: % x", p)
+	}
+	var packet []byte
+	for i := 1; i < len(p)-1; i++ {
+		b := p[i]
+		if b == slipEscape {
+			i++
+			switch p[i] {
+			case slipEscapedEnd:
+				b = slipEnd
+			case slipEscapedEsc:
+				b = slipEscape
+			default:
+				return 0, fmt.Errorf("invalid SLIP escape sequence in % x", p)
+			}
+		}
+		packet = append(packet, b)
+	}
+	r.handle(packet)
+	return len(p), nil
+}
+
+func (r *fakeROM) SetMode(mode *serial.Mode) error {
+	return nil
+}
+
+func (r *fakeROM) SetReadTimeout(t time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readTimeout = t
+	return nil
+}
+
+func (r *fakeROM) ResetInputBuffer() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.output = nil
+	return nil
+}
+
+func (r *fakeROM) SetDTR(dtr bool) error { return nil }
+func (r *fakeROM) SetRTS(rts bool) error { return nil }
+func (r *fakeROM) Close() error          { return nil }
+
+func (r *fakeROM) respond(op byte, value uint32, body []byte, errorCode byte) {
+	status := []byte{0, 0, 0, 0}
+	if errorCode != 0 {
+		status = []byte{1, errorCode, 0, 0}
+	}
+	body = append(append([]byte(nil), body...), status...)
+	packet := make([]byte, 8, 8+len(body))
+	packet[0] = 0x01 // Response.
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(body)))
+	binary.LittleEndian.PutUint32(packet[4:], value)
+	r.output = append(r.output, slipEncode(append(packet, body...))...)
+}
+
+func (r *fakeROM) handle(packet []byte) {
+	if len(packet) < 8 || packet[0] != 0x00 {
+		return
+	}
+	op := packet[1]
+	size := int(binary.LittleEndian.Uint16(packet[2:]))
+	check := binary.LittleEndian.Uint32(packet[4:])
+	data := packet[8:]
+	if size != len(data) {
+		r.respond(op, 0, nil, 0x05)
+		return
+	}
+	r.commands = append(r.commands, fakeCommand{op: op, data: append([]byte(nil), data...)})
+
+	word := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(data[4*i:])
+	}
+	// The newer ROM bootloaders take an extra word telling whether the
+	// data is encrypted and reject the commands without it.
+	beginLength := 16
+	if r.chip.supportsEncryptedFlash {
+		beginLength = 20
+	}
+
+	if op == opSync {
+		r.synced = true
+		for i := 0; i < r.syncResponses; i++ {
+			r.respond(op, 0, nil, 0)
+		}
+		return
+	}
+	if !r.synced {
+		// The ROM bootloader ignores everything until it is synced.
+		return
+	}
+
+	switch op {
+	case opReadReg:
+		if word(0) == chipDetectMagicRegAddr {
+			r.respond(op, r.chip.magicValues[0], nil, 0)
+		} else {
+			r.respond(op, r.regs[word(0)], nil, 0)
+		}
+
+	case opWriteReg:
+		r.regs[word(0)] = word(1)
+		r.respond(op, 0, nil, 0)
+
+	case opSpiAttach, opSpiSetParams, opChangeBaudRate:
+		r.respond(op, 0, nil, 0)
+
+	case opFlashBegin:
+		if len(data) != beginLength {
+			r.respond(op, 0, nil, 0x05)
+			return
+		}
+		r.respond(op, 0, nil, 0)
+
+	case opFlashDeflBegin:
+		if len(data) != beginLength {
+			r.respond(op, 0, nil, 0x05)
+			return
+		}
+		eraseSize, blocks, offset := word(0), int(word(1)), word(3)
+		if int(offset+eraseSize) > len(r.flash) {
+			r.respond(op, 0, nil, 0x06)
+			return
+		}
+		for i := offset; i < offset+eraseSize; i++ {
+			r.flash[i] = 0xff
+		}
+		r.deflOffset = offset
+		r.deflBlocks = blocks
+		r.deflSeq = 0
+		r.deflCompressed = nil
+		r.respond(op, 0, nil, 0)
+
+	case opFlashDeflData:
+		block := data[16:]
+		if int(word(0)) != len(block) {
+			r.respond(op, 0, nil, 0x05)
+			return
+		}
+		if checksum(block) != check {
+			r.respond(op, 0, nil, 0x07)
+			return
+		}
+		if int(word(1)) != r.deflSeq || r.deflSeq >= r.deflBlocks {
+			r.respond(op, 0, nil, 0x06)
+			return
+		}
+		r.deflSeq++
+		r.deflCompressed = append(r.deflCompressed, block...)
+		if r.deflSeq == r.deflBlocks {
+			if err := r.inflate(); err != nil {
+				r.respond(op, 0, nil, 0x0b)
+				return
+			}
+		}
+		r.respond(op, 0, nil, 0)
+
+	case opFlashDeflEnd:
+		r.respond(op, 0, nil, 0)
+
+	case opSpiFlashMD5:
+		offset, size := word(0), word(1)
+		if int(offset+size) > len(r.flash) {
+			r.respond(op, 0, nil, 0x09)
+			return
+		}
+		sum := md5.Sum(r.flash[offset : offset+size])
+		r.respond(op, 0, []byte(hex.EncodeToString(sum[:])), 0)
+
+	case opReadFlashSlow:
+		if !r.chip.supportsReadFlash {
+			r.respond(op, 0, nil, 0x05)
+			return
+		}
+		offset, size := word(0), word(1)
+		if size > flashReadSlowSize || int(offset+size) > len(r.flash) {
+			r.respond(op, 0, nil, 0x0a)
+			return
+		}
+		// The ROM bootloader always sends a full block.
+		body := make([]byte, flashReadSlowSize)
+		copy(body, r.flash[offset:offset+size])
+		r.respond(op, 0, body, 0)
+
+	default:
+		r.respond(op, 0, nil, 0x05)
+	}
+}
+
+func (r *fakeROM) inflate() error {
+	z, err := zlib.NewReader(bytes.NewReader(r.deflCompressed))
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		return err
+	}
+	if int(r.deflOffset)+len(data) > len(r.flash) {
+		return fmt.Errorf("write beyond the end of the flash")
+	}
+	for i, b := range data {
+		if r.corrupt {
+			b = ^b
+		}
+		r.flash[int(r.deflOffset)+i] = b
+	}
+	return nil
+}
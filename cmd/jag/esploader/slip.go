@@ -0,0 +1,109 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"fmt"
+	"time"
+)
+
+// The ROM bootloader frames its packets using SLIP (RFC 1055).
+const (
+	slipEnd        = 0xc0
+	slipEscape     = 0xdb
+	slipEscapedEnd = 0xdc
+	slipEscapedEsc = 0xdd
+)
+
+func slipEncode(packet []byte) []byte {
+	res := make([]byte, 0, len(packet)+2)
+	res = append(res, slipEnd)
+	for _, b := range packet {
+		switch b {
+		case slipEnd:
+			res = append(res, slipEscape, slipEscapedEnd)
+		case slipEscape:
+			res = append(res, slipEscape, slipEscapedEsc)
+		default:
+			res = append(res, b)
+		}
+	}
+	return append(res, slipEnd)
+}
+
+// slipReader reads SLIP framed packets from a port. Bytes outside of
+// packets, like the boot messages printed by the chip, are skipped.
+type slipReader struct {
+	port   Port
+	buffer []byte
+}
+
+func (r *slipReader) readByte(deadline time.Time) (byte, error) {
+	for len(r.buffer) == 0 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, ErrTimeout
+		}
+		if err := r.port.SetReadTimeout(remaining); err != nil {
+			return 0, err
+		}
+		buf := make([]byte, 1024)
+		n, err := r.port.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = buf[:n]
+	}
+	b := r.buffer[0]
+	r.buffer = r.buffer[1:]
+	return b, nil
+}
+
+func (r *slipReader) readPacket(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	var packet []byte
+	inPacket := false
+	for {
+		b, err := r.readByte(deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		if !inPacket {
+			if b == slipEnd {
+				inPacket = true
+			}
+			continue
+		}
+
+		switch b {
+		case slipEnd:
+			// Two consecutive end markers delimit an empty packet. We
+			// treat the second one as the start of the next packet.
+			if len(packet) > 0 {
+				return packet, nil
+			}
+		case slipEscape:
+			b, err = r.readByte(deadline)
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case slipEscapedEnd:
+				packet = append(packet, slipEnd)
+			case slipEscapedEsc:
+				packet = append(packet, slipEscape)
+			default:
+				return nil, fmt.Errorf("invalid SLIP escape sequence 0x%02x 0x%02x", slipEscape, b)
+			}
+		default:
+			packet = append(packet, b)
+		}
+	}
+}
+
+func (r *slipReader) reset() {
+	r.buffer = nil
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2022 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package esploader
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSlipEncode(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   []byte
+	}{
+		{[]byte{}, []byte{0xc0, 0xc0}},
+		{[]byte{0x01, 0x02}, []byte{0xc0, 0x01, 0x02, 0xc0}},
+		{[]byte{0xc0}, []byte{0xc0, 0xdb, 0xdc, 0xc0}},
+		{[]byte{0xdb}, []byte{0xc0, 0xdb, 0xdd, 0xc0}},
+		{[]byte{0xdb, 0xdc, 0xc0, 0xdd}, []byte{0xc0, 0xdb, 0xdd, 0xdc, 0xdb, 0xdc, 0xdd, 0xc0}},
+	}
+	for _, test := range tests {
+		if got := slipEncode(test.packet); !bytes.Equal(got, test.want) {
+			t.Errorf("slipEncode(% x) = % x, want % x", test.packet, got, test.want)
+		}
+	}
+}
+
+func TestSlipReader(t *testing.T) {
+	packets := [][]byte{
+		{0x01, 0x08, 0x00, 0x00},
+		{0xc0, 0xdb, 0xc0, 0xdb},
+		{0xdc, 0xdd},
+	}
+	// Boot messages before the packets and an empty packet between them
+	// are skipped.
+	input := []byte("boot messages\r\n")
+	for i, p := range packets {
+		input = append(input, slipEncode(p)...)
+		if i == 0 {
+			input = append(input, slipEnd)
+		}
+	}
+	port := newFakeROM(ESP32, 0)
+	port.output = input
+	reader := slipReader{port: port}
+	for _, want := range packets {
+		got, err := reader.readPacket(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("readPacket = % x, want % x", got, want)
+		}
+	}
+	if _, err := reader.readPacket(10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("readPacket at the end = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestSlipReaderInvalidEscape(t *testing.T) {
+	port := newFakeROM(ESP32, 0)
+	port.output = []byte{0xc0, 0x01, 0xdb, 0x02, 0xc0}
+	reader := slipReader{port: port}
+	if _, err := reader.readPacket(100 * time.Millisecond); err == nil || err == ErrTimeout {
+		t.Errorf("readPacket = %v, want an error about the escape sequence", err)
+	}
+}